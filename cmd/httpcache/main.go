@@ -1,17 +1,32 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"flag"
 	"fmt"
+	"github.com/donutloop/httpcache/internal/acl"
+	"github.com/donutloop/httpcache/internal/auth"
 	"github.com/donutloop/httpcache/internal/cache"
 	"github.com/donutloop/httpcache/internal/handler"
+	"github.com/donutloop/httpcache/internal/har"
 	"github.com/donutloop/httpcache/internal/middleware"
+	"github.com/donutloop/httpcache/internal/mitm"
+	"github.com/donutloop/httpcache/internal/parentproxy"
+	"github.com/donutloop/httpcache/internal/ratelimit"
+	"github.com/donutloop/httpcache/internal/roundtripper"
+	"github.com/donutloop/httpcache/internal/route"
 	"github.com/donutloop/httpcache/internal/size"
+	"github.com/donutloop/httpcache/internal/warmup"
 	"github.com/donutloop/httpcache/internal/xhttp"
 	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"text/tabwriter"
 	"time"
 )
@@ -19,30 +34,202 @@ import (
 func main() {
 	log.SetFlags(log.Ldate | log.Lshortfile | log.Ltime)
 
+	if len(os.Args) > 1 {
+		var run func(args []string) error
+		switch os.Args[1] {
+		case "export":
+			run = runExport
+		case "import":
+			run = runImport
+		}
+		if run != nil {
+			if err := run(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+	}
+
 	fs := flag.NewFlagSet("http-proxy", flag.ExitOnError)
 	var (
 		httpAddr                       = fs.String("http", ":8000", "serve HTTP on this address (optional)")
 		tlsAddr                        = fs.String("tls", "", "serve TLS on this address (optional)")
+		adminAddr                      = fs.String("admin", "", "serve the admin endpoints (health checks, stats, warm-up, snapshots, har) on this address (optional)")
+		adminToken                     = fs.String("admin-token", "", "bearer token of the admin endpoints, the health checks are open (optional)")
+		adminInsecure                  = fs.Bool("admin-insecure", false, "serve the admin endpoints without -admin-token on addresses other than loopback")
+		readyProbe                     = fs.String("ready-probe", "", "url of an upstream which has to answer for the proxy to be ready (optional)")
+		warmupFile                     = fs.String("warmup", "", "file of urls which are fetched into the cache at startup, - reads stdin (optional)")
+		warmupInterval                 = fs.Duration("warmup-interval", 0, "fetch the warm-up urls again at this interval (0 fetches them once)")
+		warmupConcurrency              = fs.Int("warmup-concurrency", 8, "warm-up urls which are fetched at the same time")
+		harEntries                     = fs.Int("har-entries", 0, "recent exchanges which are kept for the HAR export (0 disables the recording)")
+		harBodyLimit                   = fs.Int64("har-body-limit", 64*size.KB, "response body bytes which are kept per recorded exchange")
+		shutdownDelay                  = fs.Duration("shutdown-delay", 5*time.Second, "time the proxy reports not ready before it shuts down on SIGTERM")
 		cert                           = fs.String("cert", "server.crt", "TLS certificate")
 		key                            = fs.String("key", "server.key", "TLS key")
-		cap                            = fs.Int64("cap", 100, "capacity of cache")
+		http2                          = fs.Bool("http2", true, "serve HTTP/2 on the TLS address")
+		h2c                            = fs.Bool("h2c", false, "serve HTTP/2 without TLS (prior knowledge) on the HTTP address")
+		http2MaxStreams                = fs.Int("http2-max-streams", 250, "concurrent streams of an HTTP/2 client connection")
+		http2StreamBuffer              = fs.Int("http2-stream-buffer", int(1*size.MB), "receive buffer of an HTTP/2 stream in bytes")
+		http2ConnBuffer                = fs.Int("http2-conn-buffer", int(1*size.MB), "receive buffer of an HTTP/2 client connection in bytes")
+		cap                            = fs.Int64("cap", 100*size.MB, "capacity of cache in bytes")
 		responseBodyContentLenghtLimit = fs.Int64("rbcl", 500*size.MB, "response size limit")
 		expire                         = fs.Int64("expire", 5, "the items in the cache expire after or expire never")
+		cachePOST                      = fs.Bool("cache-post", false, "cache responses of POST requests keyed by their body")
+		rangeFetchFull                 = fs.Bool("range-fetch-full", false, "fetch the full object on range requests which miss the cache")
+		compress                       = fs.Bool("compress", false, "store uncompressed response bodies gzipped")
+		sliceSize                      = fs.Int64("slice", 0, "cache objects larger than slice in slices of this size (0 disables slicing)")
+		routesFile                     = fs.String("routes", "", "routes file of the reverse proxy mode (optional)")
+		forwardProxy                   = fs.Bool("forward", true, "serve forward proxy requests, absolute URLs and CONNECT, next to the routes")
+		mitmCert                       = fs.String("mitm-cert", "", "CA certificate which signs the certificates of intercepted hosts (optional)")
+		mitmKey                        = fs.String("mitm-key", "", "CA key which signs the certificates of intercepted hosts (optional)")
+		mitmHosts                      mitm.Hosts
+		mitmTunnel                     mitm.Hosts
+		tunnelPorts                    = handler.Ports{"443"}
+		tunnelDialTimeout              = fs.Duration("tunnel-dial-timeout", 10*time.Second, "timeout of connecting CONNECT tunnels")
+		tunnelIdleTimeout              = fs.Duration("tunnel-idle-timeout", 5*time.Minute, "CONNECT tunnels and upgraded connections without traffic are closed after this time")
+		upstreamProxy                  = fs.String("upstream-proxy", "", "parent proxy of the outbound traffic, http, https, socks5 or socks5h url (optional)")
+		upstreamProxyRules             parentproxy.Rules
+		noProxy                        = fs.String("no-proxy", noProxyEnv(), "comma separated destinations which bypass the parent proxy (NO_PROXY format)")
+		upstreamMaxIdle                = fs.Int("upstream-max-idle", 100, "idle connections kept to all origins (0 means no limit)")
+		upstreamMaxIdlePerHost         = fs.Int("upstream-max-idle-per-host", 16, "idle connections kept to a single origin")
+		upstreamMaxConnsPerHost        = fs.Int("upstream-max-conns-per-host", 0, "connections to a single origin (0 means no limit)")
+		upstreamDialTimeout            = fs.Duration("upstream-dial-timeout", 30*time.Second, "timeout of connecting to origins")
+		upstreamTLSTimeout             = fs.Duration("upstream-tls-timeout", 10*time.Second, "timeout of the TLS handshake with origins")
+		upstreamHeaderTimeout          = fs.Duration("upstream-response-header-timeout", 0, "timeout of waiting for the response headers of origins (0 means no timeout)")
+		upstreamIdleTimeout            = fs.Duration("upstream-idle-timeout", 90*time.Second, "idle connections to origins are closed after this time")
+		upstreamKeepAlive              = fs.Duration("upstream-keep-alive", 30*time.Second, "interval of TCP keep-alive probes to origins (negative disables them)")
+		upstreamNoKeepAlives           = fs.Bool("upstream-disable-keep-alives", false, "use a new connection to the origin per request")
+		upstreamHTTP2                  = fs.Bool("upstream-http2", true, "negotiate HTTP/2 with TLS origins")
+		upstreamCA                     = fs.String("upstream-ca", "", "comma separated PEM files of the CAs which verify origins (default system CAs)")
+		upstreamCert                   = fs.String("upstream-client-cert", "", "client certificate presented to origins requiring mutual TLS (optional)")
+		upstreamKey                    = fs.String("upstream-client-key", "", "key of the client certificate (optional)")
+		upstreamResolve                = xhttp.Resolve{}
+		upstreamDNS                    = fs.String("upstream-dns", "", "DNS server which resolves origins, host[:port] (default system resolver)")
+		ssrfGuard                      = fs.Bool("ssrf-guard", true, "block connections to loopback, link-local, private and other internal addresses")
+		ssrfAllow                      xhttp.Allowlist
+		aclFile                        = fs.String("acl", "", "access control list file of clients and destinations (optional)")
+		proxyHtpasswd                  = fs.String("proxy-htpasswd", "", "htpasswd file of the users of the forward proxy, apr1 or sha1 hashes (optional)")
+		proxyTokens                    = fs.String("proxy-tokens", "", "file of name:token lines, bearer tokens of the forward proxy (optional)")
+		proxyRealm                     = fs.String("proxy-realm", "httpcache", "realm of the proxy authentication challenges")
+		proxyAuthFailures              = fs.Int("proxy-auth-failures", 10, "failed proxy authentications per minute of a client IP, further attempts get 429 (0 disables the limit)")
+		rateLimit                      = fs.Float64("rate-limit", 0, "requests per second of a client, the user or else the IP (0 disables the limit)")
+		rateBurst                      = fs.Int("rate-burst", 0, "requests a client may burst above the rate limit (default the rate)")
+		maxConcurrent                  = fs.Int("max-concurrent", 0, "concurrent requests and tunnels of a client (0 disables the limit)")
+		missRateLimit                  = fs.Float64("miss-rate-limit", 0, "cache misses per second of a client which reach the origins (0 disables the limit)")
+		missBurst                      = fs.Int("miss-burst", 0, "cache misses a client may burst above the miss rate limit (default the rate)")
+		originMaxInFlight              = fs.Int("origin-max-inflight", 0, "in-flight requests per origin host (0 means no limit)")
+		originQueueTimeout             = fs.Duration("origin-queue-timeout", 10*time.Second, "time requests wait for a free slot of a busy origin (0 fails at once)")
+		originFailures                 = fs.Int("origin-failures", 0, "consecutive failures which open the circuit of an origin (0 disables the breaker)")
+		originOpenTimeout              = fs.Duration("origin-open-timeout", 30*time.Second, "time until an open circuit probes the origin again")
+		originServeStale               = fs.Bool("origin-serve-stale", true, "answer requests to origins with an open circuit from stale cache entries")
+		statusTTL                      = roundtripper.StatusTTL{}
+		warmupHeader                   = warmup.Headers{}
 	)
+	fs.Var(&ssrfAllow, "ssrf-allow", "comma separated CIDRs, IPs and host[:port] globs which bypass the ssrf guard")
+	fs.Var(upstreamResolve, "upstream-resolve", "connect host to address instead of resolving it, host=ip[:port] (repeatable)")
+	fs.Var(&upstreamProxyRules, "upstream-proxy-rule", "parent proxy of matching destinations, pattern=url or pattern=direct (repeatable)")
+	fs.Var(&tunnelPorts, "tunnel-ports", "comma separated ports CONNECT tunnels may be opened to (empty allows all ports)")
+	fs.Var(&mitmHosts, "mitm-hosts", "comma separated host patterns which are intercepted (default all hosts)")
+	fs.Var(&mitmTunnel, "mitm-tunnel", "comma separated host patterns which are never intercepted")
+	fs.Var(warmupHeader, "warmup-header", "header of the warm-up requests, Name: value (repeatable), e.g. the User-Agent of the clients")
+	// the defaults are replaced, not merged, if the flag is given
+	defaultStatusTTL := roundtripper.StatusTTL{}
+	defaultStatusTTL.Set("301=header,308=header,404=1m,410=1m,5xx=0s")
+	fs.Var(statusTTL, "status-ttl", "cache duration per status code or class (0s never caches, header follows Cache-Control)")
+	fs.Lookup("status-ttl").DefValue = defaultStatusTTL.String()
 	fs.Usage = usageFor(fs, "httpcache [flags]")
 	fs.Parse(os.Args[1:])
 
+	statusTTLGiven := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == "status-ttl" {
+			statusTTLGiven = true
+		}
+	})
+	if !statusTTLGiven {
+		for status, ttl := range defaultStatusTTL {
+			statusTTL[status] = ttl
+		}
+	}
+
 	logger := log.New(os.Stderr, "", log.LstdFlags)
 
 	logger.Print(
 		"\n",
 		fmt.Sprintf("http addr: %v \n", *httpAddr),
 		fmt.Sprintf("tls addr: %v \n", *tlsAddr),
+		fmt.Sprintf("admin addr: %v \n", *adminAddr),
+		fmt.Sprintf("admin insecure: %v \n", *adminInsecure),
+		fmt.Sprintf("ready probe: %v \n", *readyProbe),
+		fmt.Sprintf("warmup: %v \n", *warmupFile),
+		fmt.Sprintf("warmup interval: %v \n", *warmupInterval),
+		fmt.Sprintf("warmup concurrency: %v \n", *warmupConcurrency),
+		fmt.Sprintf("warmup header: %v \n", warmupHeader),
+		fmt.Sprintf("har entries: %v \n", *harEntries),
+		fmt.Sprintf("har body limit: %v \n", *harBodyLimit),
+		fmt.Sprintf("shutdown delay: %v \n", *shutdownDelay),
+		fmt.Sprintf("http2: %v \n", *http2),
+		fmt.Sprintf("h2c: %v \n", *h2c),
+		fmt.Sprintf("http2 max streams: %v \n", *http2MaxStreams),
+		fmt.Sprintf("http2 stream buffer: %v \n", *http2StreamBuffer),
+		fmt.Sprintf("http2 conn buffer: %v \n", *http2ConnBuffer),
 		fmt.Sprintf("cap: %v \n", *cap),
 		fmt.Sprintf("responseBodyContentLenghtLimit: %v \n", *responseBodyContentLenghtLimit),
 		fmt.Sprintf("expire: %v \n", *expire),
+		fmt.Sprintf("status ttl: %v \n", statusTTL),
+		fmt.Sprintf("cache post: %v \n", *cachePOST),
+		fmt.Sprintf("range fetch full: %v \n", *rangeFetchFull),
+		fmt.Sprintf("slice: %v \n", *sliceSize),
+		fmt.Sprintf("compress: %v \n", *compress),
+		fmt.Sprintf("routes: %v \n", *routesFile),
+		fmt.Sprintf("forward: %v \n", *forwardProxy),
+		fmt.Sprintf("mitm cert: %v \n", *mitmCert),
+		fmt.Sprintf("mitm hosts: %v \n", mitmHosts.String()),
+		fmt.Sprintf("mitm tunnel: %v \n", mitmTunnel.String()),
+		fmt.Sprintf("tunnel ports: %v \n", tunnelPorts.String()),
+		fmt.Sprintf("tunnel dial timeout: %v \n", *tunnelDialTimeout),
+		fmt.Sprintf("tunnel idle timeout: %v \n", *tunnelIdleTimeout),
+		fmt.Sprintf("upstream proxy: %v \n", *upstreamProxy),
+		fmt.Sprintf("upstream proxy rules: %v \n", upstreamProxyRules.String()),
+		fmt.Sprintf("no proxy: %v \n", *noProxy),
+		fmt.Sprintf("upstream max idle: %v \n", *upstreamMaxIdle),
+		fmt.Sprintf("upstream max idle per host: %v \n", *upstreamMaxIdlePerHost),
+		fmt.Sprintf("upstream max conns per host: %v \n", *upstreamMaxConnsPerHost),
+		fmt.Sprintf("upstream dial timeout: %v \n", *upstreamDialTimeout),
+		fmt.Sprintf("upstream tls timeout: %v \n", *upstreamTLSTimeout),
+		fmt.Sprintf("upstream response header timeout: %v \n", *upstreamHeaderTimeout),
+		fmt.Sprintf("upstream idle timeout: %v \n", *upstreamIdleTimeout),
+		fmt.Sprintf("upstream keep alive: %v \n", *upstreamKeepAlive),
+		fmt.Sprintf("upstream disable keep alives: %v \n", *upstreamNoKeepAlives),
+		fmt.Sprintf("upstream http2: %v \n", *upstreamHTTP2),
+		fmt.Sprintf("upstream ca: %v \n", *upstreamCA),
+		fmt.Sprintf("upstream client cert: %v \n", *upstreamCert),
+		fmt.Sprintf("upstream resolve: %v \n", upstreamResolve.String()),
+		fmt.Sprintf("upstream dns: %v \n", *upstreamDNS),
+		fmt.Sprintf("ssrf guard: %v \n", *ssrfGuard),
+		fmt.Sprintf("ssrf allow: %v \n", ssrfAllow.String()),
+		fmt.Sprintf("acl: %v \n", *aclFile),
+		fmt.Sprintf("proxy htpasswd: %v \n", *proxyHtpasswd),
+		fmt.Sprintf("proxy tokens: %v \n", *proxyTokens),
+		fmt.Sprintf("proxy realm: %v \n", *proxyRealm),
+		fmt.Sprintf("proxy auth failures: %v \n", *proxyAuthFailures),
+		fmt.Sprintf("rate limit: %v \n", *rateLimit),
+		fmt.Sprintf("rate burst: %v \n", *rateBurst),
+		fmt.Sprintf("max concurrent: %v \n", *maxConcurrent),
+		fmt.Sprintf("miss rate limit: %v \n", *missRateLimit),
+		fmt.Sprintf("miss burst: %v \n", *missBurst),
+		fmt.Sprintf("origin max inflight: %v \n", *originMaxInFlight),
+		fmt.Sprintf("origin queue timeout: %v \n", *originQueueTimeout),
+		fmt.Sprintf("origin failures: %v \n", *originFailures),
+		fmt.Sprintf("origin open timeout: %v \n", *originOpenTimeout),
+		fmt.Sprintf("origin serve stale: %v \n", *originServeStale),
 	)
 
+	// the admin endpoints export and replace the cache, they aren't opened to the network by accident
+	if *adminAddr != "" && *adminToken == "" && !*adminInsecure && !loopback(*adminAddr) {
+		logger.Fatal("admin endpoints need -admin-token unless they listen on loopback or -admin-insecure is set")
+	}
+
 	e := time.Duration(*expire) * (time.Hour * 24)
 	c := cache.NewLRUCache(*cap, e)
 	{
@@ -52,17 +239,259 @@ func main() {
 		}
 	}
 
+	parent := &parentproxy.Config{
+		Rules:   upstreamProxyRules,
+		NoProxy: *noProxy,
+	}
+	if *upstreamProxy != "" {
+		var err error
+		parent.Default, err = parentproxy.Parse(*upstreamProxy)
+		if err != nil {
+			logger.Fatal(err)
+		}
+	}
+
+	var routes route.Table
+	if *routesFile != "" {
+		var err error
+		routes, err = route.Load(*routesFile)
+		if err != nil {
+			logger.Fatal(err)
+		}
+	}
+	if !*forwardProxy && *routesFile == "" {
+		logger.Fatal("-forward=false requires -routes, nothing could be served otherwise")
+	}
+
+	var probe *url.URL
+	if *readyProbe != "" {
+		var err error
+		probe, err = url.Parse(*readyProbe)
+		if err != nil {
+			logger.Fatal(err)
+		}
+	}
+
+	var guard *xhttp.Guard
+	if *ssrfGuard {
+		guard = &xhttp.Guard{Allow: ssrfAllow}
+		// the configured parent proxies, origins, ready probe and resolve overrides are trusted
+		trusted := routes.Origins()
+		if parent.Default != nil {
+			trusted = append(trusted, parent.Default)
+		}
+		if probe != nil {
+			trusted = append(trusted, probe)
+		}
+		for _, rule := range parent.Rules {
+			if rule.Proxy != nil {
+				trusted = append(trusted, rule.Proxy)
+			}
+		}
+		for _, u := range trusted {
+			if err := guard.Allow.Set(hostport(u)); err != nil {
+				logger.Fatal(err)
+			}
+		}
+		for host := range upstreamResolve {
+			if err := guard.Allow.Set(host); err != nil {
+				logger.Fatal(err)
+			}
+		}
+	}
+
+	transportConfig := xhttp.TransportConfig{
+		MaxIdleConns:          *upstreamMaxIdle,
+		MaxIdleConnsPerHost:   *upstreamMaxIdlePerHost,
+		MaxConnsPerHost:       *upstreamMaxConnsPerHost,
+		DialTimeout:           *upstreamDialTimeout,
+		TLSHandshakeTimeout:   *upstreamTLSTimeout,
+		ResponseHeaderTimeout: *upstreamHeaderTimeout,
+		IdleConnTimeout:       *upstreamIdleTimeout,
+		KeepAlive:             *upstreamKeepAlive,
+		DisableKeepAlives:     *upstreamNoKeepAlives,
+		HTTP2:                 *upstreamHTTP2,
+		ClientCert:            *upstreamCert,
+		ClientKey:             *upstreamKey,
+		Resolve:               upstreamResolve,
+		DNSServer:             *upstreamDNS,
+		Guard:                 guard,
+		Proxy:                 parent.ProxyFunc(),
+	}
+	for _, file := range strings.Split(*upstreamCA, ",") {
+		if file = strings.TrimSpace(file); file != "" {
+			transportConfig.RootCAs = append(transportConfig.RootCAs, file)
+		}
+	}
+	transport, dial, err := xhttp.NewTransport(transportConfig)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	// parent proxies and tunnels are dialed with the resolver of the origins
+	parent.Dial = dial
+	parent.Resolver = transportConfig.Resolver()
+	parent.Resolve = upstreamResolve.Address
+	transport.DialContext = parent.DialTransport
+	if guard != nil {
+		// destinations handed to parent proxies are checked as far as they're known
+		parent.Check = guard.CheckAddr
+	}
+
+	// the health checks of the origins stop with the servers
+	stopHealthChecks := make(chan struct{})
+	routes.StartHealthChecks(transport, logger.Println, stopHealthChecks)
+
+	var upstream http.RoundTripper = transport
+	if *originMaxInFlight > 0 || *originFailures > 0 {
+		upstream = &roundtripper.BreakerTransport{
+			Transport:    transport,
+			MaxInFlight:  *originMaxInFlight,
+			QueueTimeout: *originQueueTimeout,
+			Failures:     *originFailures,
+			OpenTimeout:  *originOpenTimeout,
+		}
+	}
+
+	var interceptor *mitm.Interceptor
+	if *mitmCert != "" || *mitmKey != "" {
+		ca, err := tls.LoadX509KeyPair(*mitmCert, *mitmKey)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		certs, err := mitm.NewCertStore(ca)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		interceptor = &mitm.Interceptor{
+			Certs:     certs,
+			Intercept: mitmHosts,
+			Tunnel:    mitmTunnel,
+		}
+	}
+
 	stats := handler.NewStats(c, logger.Println)
 	ping := handler.NewPing(logger.Println)
+	health := handler.NewHealth(logger.Println)
+	if probe != nil {
+		health.AddCheck("upstream probe", handler.ProbeURL(transport, probe.String()))
+	}
 	proxy := handler.NewProxy(
 		c,
 		logger.Println,
 		*responseBodyContentLenghtLimit,
-		ping,
 		stats,
+		upstream,
 	)
+	{
+		proxy.CacheTransport.StatusTTL = statusTTL
+		proxy.CacheTransport.CachePOST = *cachePOST
+		proxy.CacheTransport.FetchFullOnRange = *rangeFetchFull
+		proxy.CacheTransport.SliceSize = *sliceSize
+		proxy.CacheTransport.Compress = *compress
+		proxy.CacheTransport.ServeStale = *originFailures > 0 && *originServeStale
+		proxy.Routes = routes
+		proxy.ReverseOnly = !*forwardProxy
+		proxy.Interceptor = interceptor
+		proxy.TunnelPorts = tunnelPorts
+		proxy.TunnelDialTimeout = *tunnelDialTimeout
+		proxy.TunnelIdleTimeout = *tunnelIdleTimeout
+		proxy.Dial = parent.DialContext
+	}
+	var recorder *har.Recorder
+	if *harEntries > 0 {
+		recorder = har.NewRecorder(*harEntries, *harBodyLimit)
+		proxy.LoggedTransport.Recorder = recorder
+	}
+	if *missRateLimit > 0 {
+		// only the requests which pass the cache reach the limiter
+		proxy.CacheTransport.Transport = &ratelimit.Transport{
+			Transport: proxy.CacheTransport.Transport,
+			Limiter:   ratelimit.NewLimiter(*missRateLimit, *missBurst),
+		}
+	}
 
-	stack := middleware.NewPanic(proxy, logger.Println)
+	warmer := &warmup.Warmer{
+		Transport:   proxy.CacheTransport,
+		Concurrency: *warmupConcurrency,
+		Header:      http.Header(warmupHeader),
+		Logger:      logger.Println,
+	}
+	if *warmupFile != "" {
+		urls, err := warmup.ReadFile(*warmupFile)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		// the proxy isn't ready until the first warm-up is done
+		done := health.Pending("warm-up")
+		go func() {
+			warmer.Warm(context.Background(), urls, nil)
+			done()
+			if *warmupInterval <= 0 {
+				return
+			}
+			for range time.Tick(*warmupInterval) {
+				warmer.Warm(context.Background(), urls, nil)
+			}
+		}()
+	}
+
+	var next http.Handler = proxy
+	if *aclFile != "" {
+		list, err := acl.Load(*aclFile)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		next = middleware.NewACL(next, list, logger.Println)
+	}
+	// the limits and the acl see the identity of the authenticated client
+	if *rateLimit > 0 || *maxConcurrent > 0 || *missRateLimit > 0 {
+		var requests *ratelimit.Limiter
+		if *rateLimit > 0 {
+			requests = ratelimit.NewLimiter(*rateLimit, *rateBurst)
+		}
+		var concurrency *ratelimit.Concurrency
+		if *maxConcurrent > 0 {
+			concurrency = ratelimit.NewConcurrency(*maxConcurrent)
+		}
+		next = middleware.NewRateLimit(next, requests, concurrency, logger.Println)
+	}
+	if *proxyHtpasswd != "" || *proxyTokens != "" {
+		authenticator := &auth.Authenticator{Realm: *proxyRealm}
+		if *proxyHtpasswd != "" {
+			authenticator.Users, err = auth.LoadHtpasswd(*proxyHtpasswd)
+			if err != nil {
+				logger.Fatal(err)
+			}
+		}
+		if *proxyTokens != "" {
+			authenticator.Tokens, err = auth.LoadTokens(*proxyTokens)
+			if err != nil {
+				logger.Fatal(err)
+			}
+		}
+		proxyAuth := middleware.NewProxyAuth(next, authenticator, logger.Println)
+		{
+			proxyAuth.Routes = routes
+			if *proxyAuthFailures > 0 {
+				proxyAuth.Failures = ratelimit.NewLimiter(float64(*proxyAuthFailures)/60, *proxyAuthFailures)
+			}
+		}
+		next = proxyAuth
+	}
+
+	stack := middleware.NewPanic(next, logger.Println)
+	// the decrypted requests of intercepted tunnels pass the same checks
+	proxy.Handler = stack
+
+	http2Config := &http.HTTP2Config{
+		MaxConcurrentStreams:          *http2MaxStreams,
+		MaxReceiveBufferPerStream:     *http2StreamBuffer,
+		MaxReceiveBufferPerConnection: *http2ConnBuffer,
+	}
+
+	// the servers run side by side, the first one which fails stops them all
+	var servers []*xhttp.Server
+	errc := make(chan error, 3)
 
 	if *httpAddr != "" {
 		listener, err := net.Listen("tcp", *httpAddr)
@@ -70,15 +499,19 @@ func main() {
 			log.Fatal(err)
 		}
 
-		xserver := xhttp.Server{
-			Server:          &http.Server{Addr: *httpAddr, Handler: stack},
+		protocols := new(http.Protocols)
+		protocols.SetHTTP1(true)
+		protocols.SetUnencryptedHTTP2(*h2c)
+
+		xserver := &xhttp.Server{
+			Server:          &http.Server{Addr: *httpAddr, Handler: stack, Protocols: protocols, HTTP2: http2Config},
 			Logger:          logger,
 			Listener:        listener,
 			ShutdownTimeout: 3 * time.Second,
 		}
-		if err := xserver.Start(); err != nil {
-			xserver.Stop()
-		}
+		servers = append(servers, xserver)
+		health.AddCheck("http listener", listening(listener.Addr().String()))
+		go func() { errc <- xserver.Start() }()
 	} else {
 		logger.Printf("not serving HTTP")
 	}
@@ -90,18 +523,114 @@ func main() {
 			logger.Fatal(err)
 		}
 
-		xserver := xhttp.Server{
-			Server:          &http.Server{Addr: *tlsAddr, Handler: stack},
+		protocols := new(http.Protocols)
+		protocols.SetHTTP1(true)
+		protocols.SetHTTP2(*http2)
+
+		xserver := &xhttp.Server{
+			Server:          &http.Server{Addr: *tlsAddr, Handler: stack, Protocols: protocols, HTTP2: http2Config},
 			Logger:          logger,
 			Listener:        listener,
 			ShutdownTimeout: 3 * time.Second,
 		}
-		if err := xserver.StartTLS(*cert, *key); err != nil {
-			xserver.Stop()
-		}
+		servers = append(servers, xserver)
+		health.AddCheck("tls listener", listening(listener.Addr().String()))
+		go func() { errc <- xserver.StartTLS(*cert, *key) }()
 	} else {
 		logger.Printf("not serving TLS")
 	}
+
+	if *adminAddr != "" {
+		listener, err := net.Listen("tcp", *adminAddr)
+		if err != nil {
+			logger.Fatal(err)
+		}
+
+		admin := handler.NewAdmin(ping, stats, health, *adminToken, logger.Println)
+		admin.Handle("/warmup", handler.NewWarmup(warmer, logger.Println))
+		admin.Handle("/snapshot", handler.NewSnapshot(c, logger.Println))
+		admin.Handle("/har", handler.NewHAR(c, recorder, logger.Println))
+
+		xserver := &xhttp.Server{
+			Server:          &http.Server{Addr: *adminAddr, Handler: middleware.NewPanic(admin, logger.Println)},
+			Logger:          logger,
+			Listener:        listener,
+			ShutdownTimeout: 3 * time.Second,
+		}
+		servers = append(servers, xserver)
+		go func() { errc <- xserver.Start() }()
+	} else {
+		logger.Printf("not serving admin")
+	}
+
+	if len(servers) == 0 {
+		return
+	}
+
+	// on SIGTERM the proxy reports not ready first, so that the load balancer
+	// stops routing new traffic to it before the listeners close
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-errc:
+		logger.Println(err)
+	case sig := <-signals:
+		logger.Println(fmt.Sprintf("received %v, shutting down", sig))
+		health.Shutdown()
+		time.Sleep(*shutdownDelay)
+	}
+	close(stopHealthChecks)
+	for _, xserver := range servers {
+		xserver.Stop()
+	}
+}
+
+// listening returns a check which connects to the listener.
+func listening(addr string) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+}
+
+// loopback reports whether the listen address is bound to loopback only.
+func loopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// hostport returns the host:port of the url, the port defaults to the one of
+// the scheme.
+func hostport(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	switch u.Scheme {
+	case "https":
+		return net.JoinHostPort(u.Hostname(), "443")
+	case "socks5", "socks5h":
+		return net.JoinHostPort(u.Hostname(), "1080")
+	}
+	return net.JoinHostPort(u.Hostname(), "80")
+}
+
+// noProxyEnv returns the NO_PROXY environment variable.
+func noProxyEnv() string {
+	if v := os.Getenv("NO_PROXY"); v != "" {
+		return v
+	}
+	return os.Getenv("no_proxy")
 }
 
 func usageFor(fs *flag.FlagSet, short string) func() {
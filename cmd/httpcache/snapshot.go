@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/donutloop/httpcache/internal/snapshot"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// runExport downloads the snapshot of the cache of a running proxy from its
+// admin listener.
+func runExport(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	var (
+		admin      = fs.String("admin", "http://localhost:9000", "url of the admin listener of the proxy")
+		adminToken = fs.String("admin-token", "", "bearer token of the admin endpoints (optional)")
+		out        = fs.String("o", "-", "archive file, - writes stdout")
+	)
+	fs.Usage = usageFor(fs, "httpcache export [flags]")
+	fs.Parse(args)
+
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(*admin, "/")+"/snapshot", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := do(req, *adminToken)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	w := io.Writer(os.Stdout)
+	if *out != "-" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		return fmt.Errorf("could not download snapshot (%v)", err)
+	}
+	return nil
+}
+
+// runImport uploads an archive to the admin listener of a running proxy and
+// prints the report of the import.
+func runImport(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	var (
+		admin      = fs.String("admin", "http://localhost:9000", "url of the admin listener of the proxy")
+		adminToken = fs.String("admin-token", "", "bearer token of the admin endpoints (optional)")
+	)
+	fs.Usage = usageFor(fs, "httpcache import [flags] <archive|->")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("archive is missing")
+	}
+
+	r := io.Reader(os.Stdin)
+	if file := fs.Arg(0); file != "-" {
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(*admin, "/")+"/snapshot", r)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/gzip")
+	resp, err := http.DefaultClient.Do(withToken(req, *adminToken))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	report := &snapshot.Report{}
+	if err := json.NewDecoder(resp.Body).Decode(report); err != nil {
+		return fmt.Errorf("import failed (%s)", resp.Status)
+	}
+
+	v, _ := json.MarshalIndent(report, "", "  ")
+	fmt.Fprintln(os.Stdout, string(v))
+
+	if report.Error != "" {
+		return errors.New(report.Error)
+	}
+	if report.Failed > 0 {
+		return fmt.Errorf("%d entries failed", report.Failed)
+	}
+	return nil
+}
+
+// do sends the request to the admin listener, other statuses than 200 fail.
+func do(req *http.Request, token string) (*http.Response, error) {
+	resp, err := http.DefaultClient.Do(withToken(req, token))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("admin listener answered %s", resp.Status)
+	}
+	return resp, nil
+}
+
+func withToken(req *http.Request, token string) *http.Request {
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return req
+}
@@ -0,0 +1,245 @@
+package acl
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/donutloop/httpcache/internal/auth"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+const (
+	Allow = "allow"
+	Deny  = "deny"
+)
+
+// Rule allows or denies the requests which match all of its conditions, an
+// empty condition matches every request.
+type Rule struct {
+	// Action is "allow" or "deny".
+	Action string `json:"action"`
+
+	// Clients are the CIDRs or IPs of the clients.
+	Clients []string `json:"clients"`
+
+	// Users are the identities of authenticated clients.
+	Users []string `json:"users"`
+
+	// Hosts are globs like "*.example.com" or CIDRs of the destination.
+	// CIDRs match destinations given as IP only, not names which resolve
+	// into the range, the ssrf guard of the transport checks the dialed
+	// addresses.
+	Hosts []string `json:"hosts"`
+
+	// Ports of the destination, they default to 80 for http and to 443 for
+	// https and CONNECT.
+	Ports []string `json:"ports"`
+
+	// Schemes of the destination, "http" or "https". CONNECT tunnels count
+	// as https.
+	Schemes []string `json:"schemes"`
+
+	// Methods of the request, e.g. "GET" or "CONNECT".
+	Methods []string `json:"methods"`
+
+	// Reason is returned to denied clients, by default the number of the rule.
+	Reason string `json:"reason"`
+
+	clients []*net.IPNet
+}
+
+// List is a list of rules, the first matching rule decides and otherwise the
+// default action applies.
+//
+// An acl file is a JSON object, e.g.
+//
+//	{
+//		"default": "deny",
+//		"rules": [
+//			{"action": "deny", "hosts": ["169.254.0.0/16", "*.internal"], "reason": "internal destination"},
+//			{"action": "allow", "clients": ["10.0.0.0/8"], "ports": ["80", "443"]}
+//		]
+//	}
+type List struct {
+	// Default is the action of requests which match no rule, by default "allow".
+	Default string  `json:"default"`
+	Rules   []*Rule `json:"rules"`
+}
+
+// Load reads the acl file.
+func Load(file string) (*List, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	list := new(List)
+	if err := json.NewDecoder(f).Decode(list); err != nil {
+		return nil, fmt.Errorf("could not decode acl file %s (%v)", file, err)
+	}
+
+	if err := list.Init(); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// Init validates the rules.
+func (l *List) Init() error {
+	switch l.Default {
+	case "":
+		l.Default = Allow
+	case Allow, Deny:
+	default:
+		return fmt.Errorf("default action %q is unknown", l.Default)
+	}
+
+	for i, r := range l.Rules {
+		if r.Action != Allow && r.Action != Deny {
+			return fmt.Errorf("action %q of rule %d is unknown", r.Action, i+1)
+		}
+		for _, v := range r.Clients {
+			cidr, err := parseCIDR(v)
+			if err != nil {
+				return fmt.Errorf("client %q of rule %d is bad (%v)", v, i+1, err)
+			}
+			r.clients = append(r.clients, cidr)
+		}
+		for _, v := range r.Hosts {
+			if _, err := path.Match(v, ""); err != nil {
+				return fmt.Errorf("host %q of rule %d is bad (%v)", v, i+1, err)
+			}
+		}
+		if r.Reason == "" {
+			r.Reason = fmt.Sprintf("%s by rule %d", r.Action, i+1)
+		}
+	}
+	return nil
+}
+
+// Evaluate reports whether the request is allowed, and the reason if it isn't.
+func (l *List) Evaluate(req *http.Request) (bool, string) {
+	d := destinationOf(req)
+	for _, r := range l.Rules {
+		if r.match(req, d) {
+			return r.Action == Allow, r.Reason
+		}
+	}
+	return l.Default == Allow, l.Default + " by default"
+}
+
+type destination struct {
+	scheme, host, port string
+}
+
+func destinationOf(req *http.Request) destination {
+	d := destination{scheme: req.URL.Scheme}
+	hostport := req.URL.Host
+	if req.Method == http.MethodConnect {
+		d.scheme = "https"
+	} else if !req.URL.IsAbs() {
+		// origin-form requests of the reverse proxy
+		hostport = req.Host
+		d.scheme = "http"
+		if req.TLS != nil {
+			d.scheme = "https"
+		}
+	}
+
+	var err error
+	d.host, d.port, err = net.SplitHostPort(hostport)
+	if err != nil {
+		d.host = hostport
+		d.port = "80"
+		if d.scheme == "https" {
+			d.port = "443"
+		}
+	}
+	// the fully qualified form "db.internal." names the same host
+	d.host = strings.TrimSuffix(strings.ToLower(strings.Trim(d.host, "[]")), ".")
+	return d
+}
+
+func (r *Rule) match(req *http.Request, d destination) bool {
+	if len(r.clients) > 0 {
+		host, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil {
+			host = req.RemoteAddr
+		}
+		ip := net.ParseIP(host)
+		if ip == nil || !containsIP(r.clients, ip) {
+			return false
+		}
+	}
+	if len(r.Users) > 0 && !contains(r.Users, auth.Identity(req.Context()), false) {
+		return false
+	}
+	if len(r.Hosts) > 0 && !matchHost(r.Hosts, d.host) {
+		return false
+	}
+	if len(r.Ports) > 0 && !contains(r.Ports, d.port, false) {
+		return false
+	}
+	if len(r.Schemes) > 0 && !contains(r.Schemes, d.scheme, true) {
+		return false
+	}
+	if len(r.Methods) > 0 && !contains(r.Methods, req.Method, true) {
+		return false
+	}
+	return true
+}
+
+func matchHost(patterns []string, host string) bool {
+	ip := net.ParseIP(host)
+	for _, pattern := range patterns {
+		if _, cidr, err := net.ParseCIDR(pattern); err == nil {
+			if ip != nil && cidr.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		if ok, _ := path.Match(strings.ToLower(pattern), host); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func containsIP(cidrs []*net.IPNet, ip net.IP) bool {
+	for _, cidr := range cidrs {
+		if cidr.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(values []string, v string, fold bool) bool {
+	for _, value := range values {
+		if value == v || (fold && strings.EqualFold(value, v)) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseCIDR parses a CIDR or a single IP.
+func parseCIDR(v string) (*net.IPNet, error) {
+	if !strings.Contains(v, "/") {
+		ip := net.ParseIP(v)
+		if ip == nil {
+			return nil, fmt.Errorf("%q is no ip", v)
+		}
+		bits := 8 * net.IPv4len
+		if ip.To4() == nil {
+			bits = 8 * net.IPv6len
+		}
+		v = fmt.Sprintf("%s/%d", v, bits)
+	}
+	_, cidr, err := net.ParseCIDR(v)
+	return cidr, err
+}
@@ -0,0 +1,67 @@
+package acl
+
+import (
+	"github.com/donutloop/httpcache/internal/auth"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestList_Evaluate(t *testing.T) {
+	list := &List{
+		Default: Deny,
+		Rules: []*Rule{
+			{Action: Deny, Hosts: []string{"169.254.0.0/16", "*.internal"}, Reason: "internal destination"},
+			{Action: Allow, Users: []string{"admin"}},
+			{Action: Deny, Methods: []string{"connect"}, Ports: []string{"22"}},
+			{Action: Allow, Clients: []string{"10.0.0.0/8", "192.0.2.1"}, Schemes: []string{"http", "https"}},
+		},
+	}
+	if err := list.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		method, target, remote, user string
+		allowed                      bool
+		reason                       string
+	}{
+		{http.MethodGet, "http://example.com/", "10.1.2.3:5000", "", true, "allow by rule 4"},
+		{http.MethodGet, "http://example.com/", "192.0.2.1:5000", "", true, "allow by rule 4"},
+		{http.MethodGet, "http://example.com/", "192.0.2.2:5000", "", false, "deny by default"},
+		{http.MethodGet, "http://169.254.169.254/latest/meta-data", "10.1.2.3:5000", "", false, "internal destination"},
+		{http.MethodConnect, "db.internal:443", "10.1.2.3:5000", "admin", false, "internal destination"},
+		{http.MethodConnect, "db.internal.:443", "10.1.2.3:5000", "admin", false, "internal destination"},
+		{http.MethodGet, "http://DB.Internal./", "10.1.2.3:5000", "", false, "internal destination"},
+		{http.MethodConnect, "example.com:22", "10.1.2.3:5000", "", false, "deny by rule 3"},
+		{http.MethodConnect, "example.com:22", "192.0.2.2:5000", "admin", true, "allow by rule 2"},
+		{http.MethodConnect, "example.com:443", "10.1.2.3:5000", "", true, "allow by rule 4"},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(test.method, test.target, nil)
+		req.RemoteAddr = test.remote
+		if test.user != "" {
+			req = req.WithContext(auth.WithIdentity(req.Context(), test.user))
+		}
+
+		allowed, reason := list.Evaluate(req)
+		if allowed != test.allowed || reason != test.reason {
+			t.Errorf("evaluation of %s %s from %s is bad, got=(%v, %s)", test.method, test.target, test.remote, allowed, reason)
+		}
+	}
+}
+
+func TestList_Init(t *testing.T) {
+	lists := []*List{
+		{Default: "block"},
+		{Rules: []*Rule{{Action: "permit"}}},
+		{Rules: []*Rule{{Action: Allow, Clients: []string{"10.0.0.0/33"}}}},
+		{Rules: []*Rule{{Action: Allow, Hosts: []string{"[a-"}}}},
+	}
+	for _, list := range lists {
+		if err := list.Init(); err == nil {
+			t.Errorf("list %+v is accepted", list)
+		}
+	}
+}
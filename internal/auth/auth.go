@@ -0,0 +1,119 @@
+package auth
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Tokens maps static bearer tokens to the identity they authenticate.
+type Tokens map[string]string
+
+// LoadTokens reads a file with name:token lines.
+func LoadTokens(file string) (Tokens, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tokens := make(Tokens)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, fmt.Errorf("line %d of token file %s is not of the form name:token", n, file)
+		}
+		tokens[kv[1]] = kv[0]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// Lookup returns the identity of the token.
+func (t Tokens) Lookup(token string) (string, bool) {
+	// all tokens are compared, so that the timing doesn't reveal a match
+	var identity string
+	for candidate, name := range t {
+		if subtle.ConstantTimeCompare([]byte(candidate), []byte(token)) == 1 {
+			identity = name
+		}
+	}
+	return identity, identity != ""
+}
+
+// Authenticator checks the Proxy-Authorization header of requests, Basic
+// credentials against the htpasswd users and Bearer tokens against the static
+// tokens.
+type Authenticator struct {
+	Users  Htpasswd
+	Tokens Tokens
+	Realm  string
+}
+
+// Authenticate returns the identity of the client.
+func (a *Authenticator) Authenticate(req *http.Request) (string, bool) {
+	scheme, credentials := splitAuthorization(req.Header.Get("Proxy-Authorization"))
+	switch {
+	case strings.EqualFold(scheme, "Basic") && a.Users != nil:
+		decoded, err := base64.StdEncoding.DecodeString(credentials)
+		if err != nil {
+			return "", false
+		}
+		kv := strings.SplitN(string(decoded), ":", 2)
+		if len(kv) != 2 || !a.Users.Verify(kv[0], kv[1]) {
+			return "", false
+		}
+		return kv[0], true
+	case strings.EqualFold(scheme, "Bearer") && a.Tokens != nil:
+		return a.Tokens.Lookup(credentials)
+	}
+	return "", false
+}
+
+// Challenges returns the Proxy-Authenticate values of a 407 response.
+func (a *Authenticator) Challenges() []string {
+	var challenges []string
+	if a.Users != nil {
+		challenges = append(challenges, fmt.Sprintf("Basic realm=%q, charset=\"UTF-8\"", a.Realm))
+	}
+	if a.Tokens != nil {
+		challenges = append(challenges, fmt.Sprintf("Bearer realm=%q", a.Realm))
+	}
+	return challenges
+}
+
+func splitAuthorization(v string) (scheme, credentials string) {
+	kv := strings.SplitN(strings.TrimSpace(v), " ", 2)
+	if len(kv) != 2 {
+		return "", ""
+	}
+	return kv[0], strings.TrimSpace(kv[1])
+}
+
+type identityKey struct{}
+
+// WithIdentity returns a copy of the context which carries the identity of
+// the authenticated client.
+func WithIdentity(ctx context.Context, identity string) context.Context {
+	return context.WithValue(ctx, identityKey{}, identity)
+}
+
+// Identity returns the identity of the authenticated client, empty if the
+// request isn't authenticated.
+func Identity(ctx context.Context) string {
+	identity, _ := ctx.Value(identityKey{}).(string)
+	return identity
+}
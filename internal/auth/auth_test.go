@@ -0,0 +1,52 @@
+package auth
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestHtpasswd_Verify(t *testing.T) {
+	f, err := ioutil.TempFile("", "htpasswd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("# users\nalice:$apr1$r31cRSsl$z7KlaHE5Pzgx2U7D9Cx60/\nbob:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n")
+	f.Close()
+
+	users, err := LoadHtpasswd(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		user, password string
+		ok             bool
+	}{
+		{"alice", "secret", true},
+		{"alice", "Secret", false},
+		{"bob", "secret", true},
+		{"bob", "", false},
+		{"carol", "secret", false},
+	}
+	for _, test := range tests {
+		if ok := users.Verify(test.user, test.password); ok != test.ok {
+			t.Errorf("verification of %s:%s is bad, got=%v", test.user, test.password, ok)
+		}
+	}
+}
+
+func TestLoadHtpasswd_Bcrypt(t *testing.T) {
+	f, err := ioutil.TempFile("", "htpasswd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("alice:$2y$05$GxIXDrRRONOg8lfHUUcDVuQUOiCvWtz6Uw2SXzBbTHXbaw6yBt4zC\n")
+	f.Close()
+
+	if _, err := LoadHtpasswd(f.Name()); err == nil {
+		t.Fatal("bcrypt hash is accepted")
+	}
+}
@@ -0,0 +1,212 @@
+package balancer
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var NoOrigin = errors.New("no origin of the pool is available")
+
+const (
+	RoundRobin       = "round-robin"
+	LeastConnections = "least-conn"
+	ConsistentHash   = "hash"
+)
+
+// Config of a pool, zero values are replaced by defaults.
+type Config struct {
+	// Policy selects the origin of a request: RoundRobin (default),
+	// LeastConnections or ConsistentHash over the request path.
+	Policy string
+
+	// MaxFails is the number of consecutive failures after which an origin
+	// is ejected for FailTimeout, negative values disable the ejection.
+	MaxFails    int
+	FailTimeout time.Duration
+
+	// Retries is the number of other origins tried if an idempotent request
+	// fails or is answered with 502, 503 or 504, negative values disable
+	// retries.
+	Retries int
+
+	// HealthPath is requested every HealthInterval on each origin, origins
+	// which don't answer with a 2xx or 3xx within HealthTimeout are skipped.
+	// An empty path disables the active health checks.
+	HealthPath     string
+	HealthInterval time.Duration
+	HealthTimeout  time.Duration
+}
+
+// Origin is an upstream server of a pool.
+type Origin struct {
+	active int64 // in-flight requests, first field for the 64-bit alignment of atomics
+
+	URL *url.URL
+
+	mu           sync.Mutex
+	fails        int
+	ejectedUntil time.Time
+	unhealthy    bool
+}
+
+func (o *Origin) available(now time.Time) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return !o.unhealthy && !now.Before(o.ejectedUntil)
+}
+
+// Pool balances requests across a set of origins.
+type Pool struct {
+	origins []*Origin
+	config  Config
+	next    uint32
+}
+
+// NewPool creates a pool of the origins.
+func NewPool(origins []*url.URL, config Config) (*Pool, error) {
+	if len(origins) == 0 {
+		return nil, errors.New("pool has no origins")
+	}
+
+	switch config.Policy {
+	case "":
+		config.Policy = RoundRobin
+	case RoundRobin, LeastConnections, ConsistentHash:
+	default:
+		return nil, fmt.Errorf("balance policy %q is unknown", config.Policy)
+	}
+	if config.MaxFails == 0 {
+		config.MaxFails = 3
+	}
+	if config.FailTimeout == 0 {
+		config.FailTimeout = 30 * time.Second
+	}
+	if config.Retries == 0 {
+		config.Retries = 1
+	}
+	if config.HealthInterval == 0 {
+		config.HealthInterval = 10 * time.Second
+	}
+	if config.HealthTimeout == 0 {
+		config.HealthTimeout = 2 * time.Second
+	}
+
+	pool := &Pool{config: config}
+	for _, u := range origins {
+		pool.origins = append(pool.origins, &Origin{URL: u})
+	}
+	return pool, nil
+}
+
+// Origins returns the origins of the pool.
+func (p *Pool) Origins() []*Origin {
+	return p.origins
+}
+
+// Pick selects an available origin for the request, origins in tried are skipped.
+func (p *Pool) Pick(req *http.Request, tried map[*Origin]bool) (*Origin, error) {
+	now := time.Now()
+	candidates := make([]*Origin, 0, len(p.origins))
+	for _, o := range p.origins {
+		if !tried[o] && o.available(now) {
+			candidates = append(candidates, o)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, NoOrigin
+	}
+
+	switch p.config.Policy {
+	case LeastConnections:
+		pick := candidates[0]
+		for _, o := range candidates[1:] {
+			if atomic.LoadInt64(&o.active) < atomic.LoadInt64(&pick.active) {
+				pick = o
+			}
+		}
+		return pick, nil
+	case ConsistentHash:
+		// rendezvous hashing, only the requests of an unavailable origin move
+		var pick *Origin
+		var max uint64
+		for _, o := range candidates {
+			h := fnv.New64a()
+			h.Write([]byte(o.URL.String()))
+			h.Write([]byte(req.URL.RequestURI()))
+			if sum := h.Sum64(); pick == nil || sum > max {
+				pick, max = o, sum
+			}
+		}
+		return pick, nil
+	}
+	return candidates[int(atomic.AddUint32(&p.next, 1)-1)%len(candidates)], nil
+}
+
+// report records the outcome of a request for the passive ejection. The only
+// origin of a pool is never ejected, like in nginx.
+func (p *Pool) report(o *Origin, failed bool) {
+	if len(p.origins) == 1 {
+		return
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if !failed {
+		o.fails = 0
+		return
+	}
+
+	o.fails++
+	if p.config.MaxFails > 0 && o.fails >= p.config.MaxFails {
+		o.ejectedUntil = time.Now().Add(p.config.FailTimeout)
+		o.fails = 0
+	}
+}
+
+// StartHealthCheck starts the routine which checks the health of the
+// origins, it stops once the stop channel is closed.
+func (p *Pool) StartHealthCheck(transport http.RoundTripper, logger func(v ...interface{}), stop <-chan struct{}) {
+	if p.config.HealthPath == "" {
+		return
+	}
+
+	client := &http.Client{Transport: transport, Timeout: p.config.HealthTimeout}
+	go func() {
+		for {
+			for _, o := range p.origins {
+				healthy := p.check(client, o)
+				o.mu.Lock()
+				changed := o.unhealthy == healthy
+				o.unhealthy = !healthy
+				o.mu.Unlock()
+				if changed {
+					logger(fmt.Sprintf("origin %s is healthy: %v", o.URL, healthy))
+				}
+			}
+
+			select {
+			case <-time.After(p.config.HealthInterval):
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+func (p *Pool) check(client *http.Client, o *Origin) bool {
+	u := *o.URL
+	u.Path = p.config.HealthPath
+	resp, err := client.Get(u.String())
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode >= 200 && resp.StatusCode < 400
+}
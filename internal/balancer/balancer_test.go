@@ -0,0 +1,172 @@
+package balancer
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestTransport(t *testing.T) {
+	var calls int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	pool, err := NewPool(origins(t, down.URL, server.URL), Config{MaxFails: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	transport := &Transport{Transport: http.DefaultTransport}
+	for i := 0; i < 4; i++ {
+		req, err := http.NewRequest(http.MethodGet, "http://api.example.com/items", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req = req.WithContext(WithPool(req.Context(), pool))
+
+		resp, err := transport.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("status code is bad (%v)", resp.StatusCode)
+		}
+	}
+
+	if calls != 4 {
+		t.Fatalf("calls are bad, got=%d", calls)
+	}
+
+	if pool.Origins()[0].available(time.Now()) {
+		t.Fatal("origin which is down isn't ejected")
+	}
+}
+
+func TestTransport_RetryStatus(t *testing.T) {
+	unavailable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer unavailable.Close()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	transport := &Transport{Transport: http.DefaultTransport}
+	get := func(pool *Pool) int {
+		req, err := http.NewRequest(http.MethodGet, "http://api.example.com/items", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := transport.RoundTrip(req.WithContext(WithPool(req.Context(), pool)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	pool, err := NewPool(origins(t, unavailable.URL, server.URL), Config{Policy: LeastConnections})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := get(pool); code != http.StatusOK {
+		t.Fatalf("status code is bad (%v)", code)
+	}
+	if active := pool.Origins()[0].active; active != 0 {
+		t.Fatalf("active requests of the retried origin are bad, got=%d", active)
+	}
+
+	// without another origin the response is passed on
+	pool, err = NewPool(origins(t, unavailable.URL), Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := get(pool); code != http.StatusServiceUnavailable {
+		t.Fatalf("status code is bad (%v)", code)
+	}
+}
+
+func TestTransport_DefaultTransport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	pool, err := NewPool(origins(t, server.URL), Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	transport := &Transport{}
+	for _, ctx := range []context.Context{context.Background(), WithPool(context.Background(), pool)} {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := transport.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("status code is bad (%v)", resp.StatusCode)
+		}
+	}
+}
+
+func TestPool_ConsistentHash(t *testing.T) {
+	pool, err := NewPool(origins(t, "http://a", "http://b", "http://c"), Config{Policy: ConsistentHash})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, "http://api.example.com/items/1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := pool.Pick(req, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		o, err := pool.Pick(req, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if o != first {
+			t.Fatalf("origin is bad, got=%v, want=%v", o.URL, first.URL)
+		}
+	}
+
+	if _, err := pool.Pick(req, map[*Origin]bool{pool.origins[0]: true, pool.origins[1]: true, pool.origins[2]: true}); err != NoOrigin {
+		t.Fatalf("error is bad (%v)", err)
+	}
+}
+
+func origins(t *testing.T, urls ...string) []*url.URL {
+	var origins []*url.URL
+	for _, v := range urls {
+		u, err := url.Parse(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		origins = append(origins, u)
+	}
+	return origins
+}
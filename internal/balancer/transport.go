@@ -0,0 +1,128 @@
+package balancer
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync/atomic"
+)
+
+type poolKey struct{}
+
+// WithPool returns a copy of the context which directs the request to the pool.
+func WithPool(ctx context.Context, pool *Pool) context.Context {
+	return context.WithValue(ctx, poolKey{}, pool)
+}
+
+// Transport sends requests which carry a pool in their context to an origin
+// of the pool, the scheme and host of the request URL are replaced by the
+// origin. Other requests are passed through.
+type Transport struct {
+	Transport http.RoundTripper // underlying transport (or default if nil)
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	pool, ok := req.Context().Value(poolKey{}).(*Pool)
+	if !ok {
+		return t.transport().RoundTrip(req)
+	}
+
+	retries := 0
+	if idempotent(req) {
+		retries = pool.config.Retries
+	}
+
+	tried := make(map[*Origin]bool)
+	origin, err := pool.Pick(req, tried)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		tried[origin] = true
+
+		outreq := new(http.Request)
+		*outreq = *req
+		u := *req.URL
+		u.Scheme = origin.URL.Scheme
+		u.Host = origin.URL.Host
+		outreq.URL = &u
+
+		atomic.AddInt64(&origin.active, 1)
+		resp, err := t.transport().RoundTrip(outreq)
+		if err != nil {
+			atomic.AddInt64(&origin.active, -1)
+			pool.report(origin, true)
+			if retries <= 0 {
+				return nil, err
+			}
+			retries--
+			if origin, err = pool.Pick(req, tried); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		failed := false
+		switch resp.StatusCode {
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			failed = true
+		}
+		pool.report(origin, failed)
+		if failed && retries > 0 {
+			// the response of the last origin is passed on if no other is left
+			if next, err := pool.Pick(req, tried); err == nil {
+				resp.Body.Close()
+				atomic.AddInt64(&origin.active, -1)
+				retries--
+				origin = next
+				continue
+			}
+		}
+
+		body := &activeBody{ReadCloser: resp.Body, origin: origin}
+		if w, ok := resp.Body.(io.Writer); ok && resp.StatusCode == http.StatusSwitchingProtocols {
+			// the body of an upgraded connection stays writable
+			resp.Body = &upgradedBody{activeBody: body, Writer: w}
+			return resp, nil
+		}
+		resp.Body = body
+		return resp, nil
+	}
+}
+
+func (t *Transport) transport() http.RoundTripper {
+	if t.Transport == nil {
+		return http.DefaultTransport
+	}
+	return t.Transport
+}
+
+// idempotent reports whether the request can be sent to another origin after
+// a failure, its body has to be replayable for that.
+func idempotent(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return req.Body == nil || req.Body == http.NoBody
+	}
+	return false
+}
+
+// activeBody counts the request as in-flight until the body is closed.
+type activeBody struct {
+	io.ReadCloser
+	origin *Origin
+	closed int32
+}
+
+func (b *activeBody) Close() error {
+	if atomic.CompareAndSwapInt32(&b.closed, 0, 1) {
+		atomic.AddInt64(&b.origin.active, -1)
+	}
+	return b.ReadCloser.Close()
+}
+
+// upgradedBody is the activeBody of a switched protocol, it's written as well.
+type upgradedBody struct {
+	*activeBody
+	io.Writer
+}
@@ -1,8 +1,9 @@
 package cache
 
 import (
+	"bytes"
 	"container/list"
-	"encoding/binary"
+	"io/ioutil"
 	"net/http"
 	"sync"
 	"time"
@@ -35,17 +36,75 @@ type LRUCache struct {
 }
 
 type CachedResponse struct {
+	// Resp holds the status line and headers, the body is kept in Body.
 	Resp *http.Response
+	Body []byte
+
+	// URL and Method of the request the response belongs to.
+	URL    string
+	Method string
+
+	// Encoding is the content coding the cache applied to the body, e.g.
+	// "gzip". It's empty if the body is stored as received from upstream.
+	Encoding string
+
+	// SliceSize is set if the body isn't part of the response, but is
+	// cached in separate entries of SliceSize bytes each.
+	SliceSize int64
+
+	// Expires is the point in time after which the response is stale,
+	// the zero value means the response doesn't go stale.
+	Expires time.Time
+}
+
+// Expired reports whether the response is stale at the given time.
+func (cp *CachedResponse) Expired(now time.Time) bool {
+	return !cp.Expires.IsZero() && now.After(cp.Expires)
 }
 
+// Size returns the bytes of the cached body and headers, a compressed body
+// is counted with its compressed size.
 func (cp *CachedResponse) Size() int {
-	return binary.Size(cp.Resp)
+	size := len(cp.Body)
+	if cp.Resp != nil {
+		for k, vv := range cp.Resp.Header {
+			for _, v := range vv {
+				size += len(k) + len(v)
+			}
+		}
+	}
+	return size
+}
+
+// Response returns a fresh copy of the cached response for the request,
+// responses to HEAD requests get no body.
+func (cp *CachedResponse) Response(req *http.Request) *http.Response {
+	resp := new(http.Response)
+	*resp = *cp.Resp
+	resp.Request = req
+	resp.Header = make(http.Header, len(cp.Resp.Header))
+	for k, vv := range cp.Resp.Header {
+		resp.Header[k] = append([]string(nil), vv...)
+	}
+
+	if req.Method == http.MethodHead {
+		resp.Body = http.NoBody
+		if cp.Body != nil {
+			resp.ContentLength = int64(len(cp.Body))
+		}
+		return resp
+	}
+
+	resp.ContentLength = int64(len(cp.Body))
+	resp.Body = ioutil.NopCloser(bytes.NewReader(cp.Body))
+	return resp
 }
 
 // Item is what is stored in the cache
 type Item struct {
-	Key   string
-	Value CachedResponse
+	Key      string
+	Value    CachedResponse
+	Accessed time.Time
 }
 
 type entry struct {
@@ -131,6 +190,60 @@ func (lru *LRUCache) Delete(key string) bool {
 	return true
 }
 
+// DeleteFunc removes all entries for which fn returns true, and returns
+// how many entries were removed.
+func (lru *LRUCache) DeleteFunc(fn func(key string, value *CachedResponse) bool) int {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	var deleted int
+	for key, element := range lru.table {
+		entry := element.Value.(*entry)
+		if !fn(key, entry.value) {
+			continue
+		}
+		lru.list.Remove(element)
+		delete(lru.table, key)
+		lru.size -= entry.size
+		deleted++
+	}
+	return deleted
+}
+
+// Items returns the entries of the cache from the least to the most recently
+// used one.
+func (lru *LRUCache) Items() []Item {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	items := make([]Item, 0, lru.list.Len())
+	for element := lru.list.Back(); element != nil; element = element.Prev() {
+		entry := element.Value.(*entry)
+		items = append(items, Item{Key: entry.key, Value: *entry.value, Accessed: entry.timeAccessed})
+	}
+	return items
+}
+
+// Restore sets the item as the most recently used entry, it keeps the access
+// time of the item. Restoring the items in the order of Items rebuilds the
+// cache. It returns the keys of the entries which were evicted to make room,
+// the key of the item as well if it doesn't fit.
+func (lru *LRUCache) Restore(item Item) (evicted []string) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	value := item.Value
+	if element := lru.table[item.Key]; element != nil {
+		evicted = lru.updateInplace(element, &value)
+	} else {
+		evicted = lru.addNew(item.Key, &value)
+	}
+	if element := lru.table[item.Key]; element != nil {
+		element.Value.(*entry).timeAccessed = item.Accessed
+	}
+	return evicted
+}
+
 // Stats returns a few stats on the cache.
 func (lru *LRUCache) Stats() (length, size, capacity int64, oldest time.Time) {
 	lru.mu.Lock()
@@ -162,14 +275,14 @@ func (lru *LRUCache) Capacity() int64 {
 	return lru.capacity
 }
 
-func (lru *LRUCache) updateInplace(element *list.Element, value *CachedResponse) {
+func (lru *LRUCache) updateInplace(element *list.Element, value *CachedResponse) []string {
 	valueSize := int64(value.Size())
 	sizeDiff := valueSize - element.Value.(*entry).size
 	element.Value.(*entry).value = value
 	element.Value.(*entry).size = valueSize
 	lru.size += sizeDiff
 	lru.moveToFront(element)
-	lru.checkCapacity()
+	return lru.checkCapacity()
 }
 
 func (lru *LRUCache) moveToFront(element *list.Element) {
@@ -177,15 +290,18 @@ func (lru *LRUCache) moveToFront(element *list.Element) {
 	element.Value.(*entry).timeAccessed = time.Now()
 }
 
-func (lru *LRUCache) addNew(key string, value *CachedResponse) {
+func (lru *LRUCache) addNew(key string, value *CachedResponse) []string {
 	newEntry := &entry{key, value, int64(value.Size()), time.Now()}
 	element := lru.list.PushFront(newEntry)
 	lru.table[key] = element
 	lru.size += newEntry.size
-	lru.checkCapacity()
+	return lru.checkCapacity()
 }
 
-func (lru *LRUCache) checkCapacity() {
+// checkCapacity evicts the least recently used entries until the cache fits
+// its capacity and returns their keys.
+func (lru *LRUCache) checkCapacity() []string {
+	var evicted []string
 	// Partially duplicated from Delete
 	for lru.size > lru.capacity {
 		delElem := lru.list.Back()
@@ -193,7 +309,9 @@ func (lru *LRUCache) checkCapacity() {
 		lru.list.Remove(delElem)
 		delete(lru.table, delValue.key)
 		lru.size -= delValue.size
+		evicted = append(evicted, delValue.key)
 	}
+	return evicted
 }
 
 // gc garbage collect all the expired entries from the cache.
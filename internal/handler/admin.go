@@ -0,0 +1,64 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// NewAdmin creates the handler of the admin listener, the endpoints other
+// than the health checks require the token if it's set.
+func NewAdmin(ping *Ping, stats *Stats, health *Health, token string, logger func(v ...interface{})) *Admin {
+	a := &Admin{
+		mux:    http.NewServeMux(),
+		token:  token,
+		logger: logger,
+	}
+	a.HandlePublic("/ping", ping)
+	a.HandlePublic("/healthz", health.Live())
+	a.HandlePublic("/readyz", health.Readiness())
+	a.Handle("/stats", stats)
+	return a
+}
+
+// Admin serves the health, stats and management endpoints of the proxy on a
+// listener of its own, so that they don't shadow the paths of proxied
+// requests.
+type Admin struct {
+	mux    *http.ServeMux
+	token  string
+	logger func(v ...interface{})
+}
+
+// Handle registers an endpoint which requires the token.
+func (a *Admin) Handle(pattern string, h http.Handler) {
+	a.mux.Handle(pattern, a.authorize(h))
+}
+
+// HandlePublic registers an endpoint which is open to all clients, e.g. for
+// the probes of the orchestrator.
+func (a *Admin) HandlePublic(pattern string, h http.Handler) {
+	a.mux.Handle(pattern, h)
+}
+
+func (a *Admin) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	a.mux.ServeHTTP(resp, req)
+}
+
+// authorize checks the bearer token of the request.
+func (a *Admin) authorize(h http.Handler) http.Handler {
+	if a.token == "" {
+		return h
+	}
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+			a.logger(fmt.Sprintf("admin authentication of %s failed (%s %s)", req.RemoteAddr, req.Method, req.URL.Path))
+			resp.Header().Set("WWW-Authenticate", `Bearer realm="httpcache admin"`)
+			resp.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(resp, req)
+	})
+}
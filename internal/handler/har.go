@@ -0,0 +1,57 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/donutloop/httpcache/internal/cache"
+	"github.com/donutloop/httpcache/internal/har"
+	"net/http"
+	"time"
+)
+
+func NewHAR(c *cache.LRUCache, recorder *har.Recorder, logger func(v ...interface{})) *HAR {
+	return &HAR{
+		c:        c,
+		recorder: recorder,
+		logger:   logger,
+	}
+}
+
+// HAR exports the recent exchanges of the proxy as HTTP archive, or the
+// contents of the cache with ?source=cache.
+type HAR struct {
+	c        *cache.LRUCache
+	recorder *har.Recorder // optional
+	logger   func(v ...interface{})
+}
+
+func (s *HAR) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	var entries []*har.Entry
+	switch source := req.URL.Query().Get("source"); source {
+	case "", "recent":
+		if s.recorder == nil {
+			resp.WriteHeader(http.StatusNotFound)
+			resp.Write([]byte("recording of exchanges is disabled"))
+			return
+		}
+		entries = s.recorder.Entries()
+	case "cache":
+		entries = har.FromCache(s.c.Items())
+	default:
+		resp.WriteHeader(http.StatusBadRequest)
+		resp.Write([]byte(fmt.Sprintf("source %q is unknown", source)))
+		return
+	}
+
+	v, err := json.Marshal(har.New(entries))
+	if err != nil {
+		s.logger(fmt.Sprintf("could not marshal response (%v)", err))
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	resp.Header().Set("Content-Type", "application/json")
+	resp.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="httpcache-%s.har"`, time.Now().UTC().Format("20060102T150405Z")))
+	resp.WriteHeader(http.StatusOK)
+	resp.Write(v)
+}
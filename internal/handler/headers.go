@@ -0,0 +1,78 @@
+package handler
+
+import (
+	"fmt"
+	"github.com/donutloop/httpcache/internal/auth"
+	"github.com/donutloop/httpcache/internal/roundtripper"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// pseudonym identifies the proxy in the Via header.
+const pseudonym = "httpcache"
+
+// outgoing returns the request which is sent upstream, without the hop-by-hop
+// headers of the client. The proxy is appended to Via and the client to
+// X-Forwarded-For.
+func outgoing(req *http.Request) *http.Request {
+	upgrade := upgradeType(req.Header)
+	trailers := hasToken(req.Header["Te"], "trailers")
+
+	outreq := new(http.Request)
+	*outreq = *req
+	outreq.Header = req.Header.Clone()
+	roundtripper.RemoveHopHeaders(outreq.Header)
+
+	if upgrade != "" {
+		outreq.Header.Set("Connection", "Upgrade")
+		outreq.Header.Set("Upgrade", upgrade)
+	}
+	if trailers {
+		// gRPC relies on it to receive its status
+		outreq.Header.Set("Te", "trailers")
+	}
+
+	outreq.Header.Add("Via", via(req.ProtoMajor, req.ProtoMinor))
+	if ip, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		if prior := outreq.Header["X-Forwarded-For"]; len(prior) > 0 {
+			ip = strings.Join(prior, ", ") + ", " + ip
+		}
+		outreq.Header.Set("X-Forwarded-For", ip)
+	}
+	return outreq
+}
+
+// incoming removes the hop-by-hop headers of the upstream from the response
+// and appends the proxy to Via.
+func incoming(resp *http.Response) {
+	roundtripper.RemoveHopHeaders(resp.Header)
+	resp.Header.Add("Via", via(resp.ProtoMajor, resp.ProtoMinor))
+}
+
+// via returns the Via entry of the proxy for a message of the protocol version.
+func via(major, minor int) string {
+	if major >= 2 {
+		return fmt.Sprintf("%d %s", major, pseudonym)
+	}
+	return fmt.Sprintf("%d.%d %s", major, minor, pseudonym)
+}
+
+func hasToken(values []string, token string) bool {
+	for _, v := range values {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// user returns the log suffix of the authenticated client of the request.
+func user(req *http.Request) string {
+	if identity := auth.Identity(req.Context()); identity != "" {
+		return " user=" + identity
+	}
+	return ""
+}
@@ -0,0 +1,150 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+func NewHealth(logger func(v ...interface{})) *Health {
+	return &Health{
+		Timeout: 5 * time.Second,
+		checks:  make(map[string]func(ctx context.Context) error),
+		pending: make(map[string]bool),
+		logger:  logger,
+	}
+}
+
+// Health answers the liveness and readiness probes. The process is live as
+// long as it answers, it's ready once all checks pass, no task is pending and
+// it isn't shutting down.
+type Health struct {
+	// Timeout limits the time of all checks of a readiness probe.
+	Timeout time.Duration
+
+	mu           sync.Mutex
+	checks       map[string]func(ctx context.Context) error
+	pending      map[string]bool
+	shuttingDown bool
+
+	logger func(v ...interface{})
+}
+
+// AddCheck adds a dependency check of the readiness probe.
+func (h *Health) AddCheck(name string, check func(ctx context.Context) error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.checks[name] = check
+}
+
+// Pending marks the proxy as not ready until the returned func is called,
+// e.g. during the warm-up of the cache.
+func (h *Health) Pending(name string) func() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.pending[name] = true
+	return func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		delete(h.pending, name)
+	}
+}
+
+// Shutdown marks the proxy as not ready, so that no new traffic is routed to
+// it while it shuts down.
+func (h *Health) Shutdown() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.shuttingDown = true
+}
+
+// Ready returns the reasons why the proxy isn't ready, nil if it is.
+func (h *Health) Ready(ctx context.Context) []string {
+	h.mu.Lock()
+	if h.shuttingDown {
+		h.mu.Unlock()
+		return []string{"shutting down"}
+	}
+	var reasons []string
+	for name := range h.pending {
+		reasons = append(reasons, fmt.Sprintf("%s is pending", name))
+	}
+	checks := make(map[string]func(ctx context.Context) error, len(h.checks))
+	for name, check := range h.checks {
+		checks[name] = check
+	}
+	h.mu.Unlock()
+
+	if h.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.Timeout)
+		defer cancel()
+	}
+
+	// the checks run concurrently, a slow dependency doesn't delay the others
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range checks {
+		wg.Add(1)
+		go func(name string, check func(ctx context.Context) error) {
+			defer wg.Done()
+			if err := check(ctx); err != nil {
+				mu.Lock()
+				reasons = append(reasons, fmt.Sprintf("%s failed (%v)", name, err))
+				mu.Unlock()
+			}
+		}(name, check)
+	}
+	wg.Wait()
+
+	sort.Strings(reasons)
+	return reasons
+}
+
+// Live answers the liveness probe.
+func (h *Health) Live() http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.WriteHeader(http.StatusOK)
+		resp.Write([]byte("ok"))
+	})
+}
+
+// Readiness answers the readiness probe, with the reasons if it's not ready.
+func (h *Health) Readiness() http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		reasons := h.Ready(req.Context())
+		if len(reasons) > 0 {
+			h.logger(fmt.Sprintf("proxy is not ready (%s)", strings.Join(reasons, ", ")))
+			resp.WriteHeader(http.StatusServiceUnavailable)
+			resp.Write([]byte(strings.Join(reasons, "\n")))
+			return
+		}
+		resp.WriteHeader(http.StatusOK)
+		resp.Write([]byte("ok"))
+	})
+}
+
+// ProbeURL returns a check which requests the URL with the transport, it
+// fails unless the response is a 2xx or 3xx.
+func ProbeURL(transport http.RoundTripper, url string) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := transport.RoundTrip(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 400 {
+			return errors.New(resp.Status)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,85 @@
+package handler
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// intercept terminates the TLS of the established CONNECT tunnel with a
+// certificate minted for the host, and serves the decrypted requests through
+// the cache. The upstream connections are encrypted again by the transport.
+// The decrypted requests carry the context of the CONNECT request and pass
+// the Handler of the proxy.
+func (p *Proxy) intercept(clientConn net.Conn, connect *http.Request) {
+	hostport := connect.URL.Host
+	p.logger(fmt.Sprintf("intercepting https of %s%s", hostport, user(connect)))
+
+	var next http.Handler = p
+	if p.Handler != nil {
+		next = p.Handler
+	}
+
+	host, _, _ := net.SplitHostPort(hostport)
+	tlsConn := tls.Server(clientConn, p.Interceptor.TLSConfig(host))
+	listener := &connListener{conn: tlsConn, done: make(chan struct{})}
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+			// the destination is the one of the tunnel, whatever the Host
+			// header of the client claims
+			req.URL.Scheme = "https"
+			req.URL.Host = hostport
+			req.Host = hostport
+			next.ServeHTTP(resp, req)
+		}),
+		BaseContext: func(net.Listener) context.Context {
+			return connect.Context()
+		},
+		IdleTimeout: 90 * time.Second,
+		ConnState: func(conn net.Conn, state http.ConnState) {
+			if state == http.StateClosed || state == http.StateHijacked {
+				listener.Close()
+			}
+		},
+	}
+	server.Serve(listener)
+}
+
+var errListenerClosed = errors.New("listener is closed")
+
+// connListener hands out a single connection and blocks until it's closed.
+type connListener struct {
+	conn net.Conn
+	once sync.Once
+	done chan struct{}
+
+	mu       sync.Mutex
+	accepted bool
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	if !l.accepted {
+		l.accepted = true
+		l.mu.Unlock()
+		return l.conn, nil
+	}
+	l.mu.Unlock()
+
+	<-l.done
+	return nil, errListenerClosed
+}
+
+func (l *connListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
@@ -1,54 +1,122 @@
 package handler
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"github.com/donutloop/httpcache/internal/balancer"
 	"github.com/donutloop/httpcache/internal/cache"
+	"github.com/donutloop/httpcache/internal/mitm"
+	"github.com/donutloop/httpcache/internal/ratelimit"
 	"github.com/donutloop/httpcache/internal/roundtripper"
+	"github.com/donutloop/httpcache/internal/route"
+	"github.com/donutloop/httpcache/internal/xhttp"
 	"io"
-	"io/ioutil"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"strings"
+	"time"
 )
 
-func NewProxy(cache *cache.LRUCache, logger func(v ...interface{}), contentLength int64, ping *Ping, stats *Stats) *Proxy {
+// NewProxy creates a proxy which caches the responses of the transport.
+func NewProxy(cache *cache.LRUCache, logger func(v ...interface{}), contentLength int64, stats *Stats, transport http.RoundTripper) *Proxy {
+	var dialer net.Dialer
+	cacheTransport := &roundtripper.CacheTransport{
+		Transport: &roundtripper.ResponseBodyLimitRoundTripper{
+			Transport: &balancer.Transport{
+				Transport: transport,
+			},
+			Limit: contentLength,
+		},
+		Cache: cache,
+	}
+	loggedTransport := &roundtripper.LoggedTransport{
+		Transport: cacheTransport,
+		Logger:    logger,
+	}
 	return &Proxy{
 		client: &http.Client{
-			Transport: &roundtripper.LoggedTransport{
-				Transport: &roundtripper.CacheTransport{
-					Transport: &roundtripper.ResponseBodyLimitRoundTripper{
-						Transport: http.DefaultTransport,
-						Limit:     contentLength,
-					},
-					Cache: cache,
-				},
-				Logger: logger,
-			}},
-		logger: logger,
-		ping:   ping,
-		stats:  stats,
+			Transport: loggedTransport,
+			// redirects are passed on to the client, so that they can be cached as well
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		CacheTransport:    cacheTransport,
+		LoggedTransport:   loggedTransport,
+		Dial:              dialer.DialContext,
+		TunnelPorts:       Ports{"443"},
+		TunnelDialTimeout: 10 * time.Second,
+		TunnelIdleTimeout: 5 * time.Minute,
+		logger:            logger,
+		stats:             stats,
 	}
 }
 
 type Proxy struct {
+	// CacheTransport caches the responses of the proxied requests.
+	CacheTransport *roundtripper.CacheTransport
+
+	// LoggedTransport logs the proxied requests.
+	LoggedTransport *roundtripper.LoggedTransport
+
+	// Interceptor terminates the TLS of CONNECT tunnels to intercepted
+	// hosts, so that their requests are cached as well. Optional.
+	Interceptor *mitm.Interceptor
+
+	// Handler serves the decrypted requests of intercepted tunnels, by
+	// default the proxy itself. It's the middleware in front of the proxy,
+	// so that they're checked like the requests in the clear.
+	Handler http.Handler
+
+	// Dial connects CONNECT tunnels to their destination.
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// TunnelPorts are the ports CONNECT tunnels may be opened to, empty
+	// allows all ports. By default only 443 is allowed.
+	TunnelPorts Ports
+
+	// TunnelDialTimeout limits the time to connect to the tunnel destination.
+	TunnelDialTimeout time.Duration
+
+	// TunnelIdleTimeout closes tunnels and upgraded connections without
+	// traffic in both directions.
+	TunnelIdleTimeout time.Duration
+
+	// Routes direct requests which don't carry an absolute URL to upstream
+	// origins, the proxy acts as reverse proxy for them.
+	Routes route.Table
+
+	// ReverseOnly rejects the requests of the forward proxy, absolute URLs
+	// and CONNECT, with 403, so that only the routes are reachable.
+	ReverseOnly bool
+
 	client *http.Client
 	logger func(v ...interface{})
-	ping   *Ping
 	stats  *Stats
 }
 
 func (p *Proxy) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
-
-	if req.URL.Path == "/ping" {
-		p.ping.ServeHTTP(resp, req)
-		return
+	if req.Method == http.MethodConnect && req.Header.Get(":protocol") != "" {
+		req = fromExtendedConnect(req)
 	}
 
-	if req.URL.Path == "/stats" {
-		p.stats.ServeHTTP(resp, req)
+	req = p.Routes.Absolute(req)
+	if p.ReverseOnly && (req.URL.IsAbs() || req.Method == http.MethodConnect) {
+		p.logger(fmt.Sprintf("proxy rejected forward request %s %s", req.Method, req.Host))
+		resp.WriteHeader(http.StatusForbidden)
 		return
 	}
+	if !req.URL.IsAbs() && req.Method != http.MethodConnect {
+		r, ok := p.Routes.Match(req)
+		if !ok {
+			p.logger(fmt.Sprintf("proxy has no route for %s%s", req.Host, req.URL.Path))
+			resp.WriteHeader(http.StatusNotFound)
+			return
+		}
+		req = r.Rewrite(req)
+	}
 
 	req.RequestURI = ""
 	if req.Method == http.MethodConnect {
@@ -56,71 +124,167 @@ func (p *Proxy) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	proxyResponse, err := p.client.Do(req)
+	if upgradeType(req.Header) != "" {
+		p.upgrade(resp, req)
+		return
+	}
+
+	p.forward(resp, req)
+}
+
+// forward sends the request through the cache to the upstream and copies
+// the response back to the client.
+func (p *Proxy) forward(resp http.ResponseWriter, req *http.Request) {
+	proxyResponse, err := p.client.Do(outgoing(req))
 	if err != nil {
-		if strings.Contains(err.Error(), roundtripper.ResponseIsToLarge.Error()) {
-			resp.WriteHeader(http.StatusRequestEntityTooLarge)
-			return
-		}
-		resp.WriteHeader(http.StatusInternalServerError)
+		writeError(resp, err)
 		return
 	}
 
+	p.copyResponse(resp, req, proxyResponse)
+}
+
+// writeError answers the error of a round trip, clients over their limit of
+// cache misses are told when to retry.
+func writeError(resp http.ResponseWriter, err error) {
+	var limitErr *ratelimit.Error
+	if errors.As(err, &limitErr) {
+		resp.Header().Set("Retry-After", limitErr.RetryAfterSeconds())
+	}
+	resp.WriteHeader(errorStatus(err))
+}
+
+// errorStatus returns the status code which answers the error of a round trip.
+func errorStatus(err error) int {
+	var limitErr *ratelimit.Error
+	if errors.As(err, &limitErr) {
+		return http.StatusTooManyRequests
+	}
+	if strings.Contains(err.Error(), roundtripper.ResponseIsToLarge.Error()) {
+		return http.StatusRequestEntityTooLarge
+	}
+	if errors.Is(err, roundtripper.CircuitIsOpen) || errors.Is(err, roundtripper.OriginIsBusy) {
+		return http.StatusServiceUnavailable
+	}
+	if strings.Contains(err.Error(), balancer.NoOrigin.Error()) {
+		return http.StatusServiceUnavailable
+	}
+	if strings.Contains(err.Error(), xhttp.DestinationIsBlocked.Error()) {
+		return http.StatusForbidden
+	}
+	return http.StatusInternalServerError
+}
+
+// copyResponse writes the response of the upstream back to the client.
+func (p *Proxy) copyResponse(resp http.ResponseWriter, req *http.Request, proxyResponse *http.Response) {
+	incoming(proxyResponse)
 	for k, vv := range proxyResponse.Header {
 		for _, v := range vv {
 			resp.Header().Add(k, v)
 		}
 	}
 
-	body, err := ioutil.ReadAll(proxyResponse.Body)
-	if err != nil {
-		p.logger(fmt.Sprintf("proxy couldn't read body of response (%v)", err))
+	// the body is streamed, sliced objects can be far larger than the memory
+	resp.WriteHeader(proxyResponse.StatusCode)
+	if _, err := io.Copy(resp, proxyResponse.Body); err != nil {
+		p.logger(fmt.Sprintf("proxy couldn't copy body of response (%v)", err))
 		requestDumped, responseDumped, err := dump(req, proxyResponse)
 		if err == nil {
 			p.logger(fmt.Sprintf("request: %#v", requestDumped))
 			p.logger(fmt.Sprintf("response: %#v", responseDumped))
 		}
-		resp.WriteHeader(http.StatusInternalServerError)
-		return
 	}
-	resp.WriteHeader(proxyResponse.StatusCode)
-	resp.Write(body)
+	proxyResponse.Body.Close()
 }
 
 func (p *Proxy) ProxyHTTPS(rw http.ResponseWriter, req *http.Request) {
-	hij, ok := rw.(http.Hijacker)
-	if !ok {
+	host, port, err := net.SplitHostPort(req.URL.Host)
+	if err != nil {
+		p.logger(fmt.Sprintf("proxy https error: %v", err))
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if !p.TunnelPorts.Allows(port) {
+		p.logger(fmt.Sprintf("proxy https error: port of %s is not allowed", req.URL.Host))
+		rw.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	if _, ok := rw.(http.Hijacker); !ok && req.ProtoMajor < 2 {
 		p.logger("proxy https error: http server does not support hijacker")
+		rw.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	clientConn, _, err := hij.Hijack()
-	if err != nil {
-		p.logger("proxy https error: %v", err)
+	if p.Interceptor.Intercepts(host) {
+		clientConn, err := establish(rw, req)
+		if err != nil {
+			p.logger(fmt.Sprintf("proxy https error: %v", err))
+			return
+		}
+		p.intercept(clientConn, req)
 		return
 	}
 
-	proxyConn, err := net.Dial("tcp", req.URL.Host)
+	// the upstream is dialed before the tunnel is established, so that failures are answered properly
+	ctx, cancel := context.WithTimeout(req.Context(), p.TunnelDialTimeout)
+	proxyConn, err := p.Dial(ctx, "tcp", req.URL.Host)
+	cancel()
 	if err != nil {
-		p.logger("proxy https error: %v", err)
+		p.logger(fmt.Sprintf("proxy https error: %v", err))
+		if errors.Is(err, xhttp.DestinationIsBlocked) {
+			rw.WriteHeader(http.StatusForbidden)
+			return
+		}
+		var netErr net.Error
+		if (errors.As(err, &netErr) && netErr.Timeout()) || errors.Is(err, context.DeadlineExceeded) {
+			rw.WriteHeader(http.StatusGatewayTimeout)
+			return
+		}
+		rw.WriteHeader(http.StatusBadGateway)
 		return
 	}
 
-	_, err = clientConn.Write([]byte("HTTP/1.0 200 OK\r\n\r\n"))
+	clientConn, err := establish(rw, req)
 	if err != nil {
-		p.logger("proxy https error: %v", err)
+		p.logger(fmt.Sprintf("proxy https error: %v", err))
+		proxyConn.Close()
 		return
 	}
 
-	go func() {
-		io.Copy(clientConn, proxyConn)
-		clientConn.Close()
-		proxyConn.Close()
-	}()
+	t := &tunnel{client: clientConn, upstream: proxyConn, idleTimeout: p.TunnelIdleTimeout}
+	start := time.Now()
+	in, out := t.splice()
+	d := time.Since(start)
+	p.logger(fmt.Sprintf("tunnel %s closed: %d bytes in, %d bytes out [%s]%s", req.URL.Host, in, out, d, user(req)))
+	p.stats.recordTunnel(in, out, d)
+}
+
+// establish answers the CONNECT request and returns the connection of the
+// client. HTTP/1 connections are hijacked, over HTTP/2 the tunnel is carried
+// by the stream of the request, so that the other streams go on.
+func establish(rw http.ResponseWriter, req *http.Request) (net.Conn, error) {
+	if req.ProtoMajor >= 2 {
+		rw.WriteHeader(http.StatusOK)
+		conn := newStreamConn(rw, req)
+		if err := conn.controller.Flush(); err != nil {
+			return nil, err
+		}
+		return conn, nil
+	}
+
+	clientConn, _, err := rw.(http.Hijacker).Hijack()
+	if err != nil {
+		return nil, err
+	}
 
-	io.Copy(proxyConn, clientConn)
-	proxyConn.Close()
-	clientConn.Close()
+	_, err = clientConn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+	if err != nil {
+		clientConn.Close()
+		return nil, err
+	}
+	return clientConn, nil
 }
 
 type requestDump []byte
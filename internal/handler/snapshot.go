@@ -0,0 +1,81 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/donutloop/httpcache/internal/cache"
+	"github.com/donutloop/httpcache/internal/size"
+	"github.com/donutloop/httpcache/internal/snapshot"
+	"net/http"
+	"time"
+)
+
+func NewSnapshot(c *cache.LRUCache, logger func(v ...interface{})) *Snapshot {
+	return &Snapshot{
+		MaxSize: 2*c.Capacity() + 1*size.MB,
+		c:       c,
+		logger:  logger,
+	}
+}
+
+// Snapshot exports the cache as archive on GET and imports an archive on
+// POST, the import is answered with its report.
+type Snapshot struct {
+	// MaxSize limits the archives which are imported, by default to twice
+	// the capacity of the cache.
+	MaxSize int64
+
+	c      *cache.LRUCache
+	logger func(v ...interface{})
+}
+
+func (s *Snapshot) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		s.export(resp)
+	case http.MethodPost:
+		s.restore(resp, req)
+	default:
+		resp.Header().Set("Allow", "GET, POST")
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Snapshot) export(resp http.ResponseWriter) {
+	resp.Header().Set("Content-Type", "application/gzip")
+	resp.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="httpcache-%s.snapshot.gz"`, time.Now().UTC().Format("20060102T150405Z")))
+	resp.WriteHeader(http.StatusOK)
+
+	n, err := snapshot.Export(resp, s.c)
+	if err != nil {
+		s.logger(fmt.Sprintf("could not export snapshot after %d entries (%v)", n, err))
+		return
+	}
+	s.logger(fmt.Sprintf("exported snapshot of %d entries", n))
+}
+
+func (s *Snapshot) restore(resp http.ResponseWriter, req *http.Request) {
+	report, err := snapshot.Import(http.MaxBytesReader(resp, req.Body, s.MaxSize), s.c)
+	status := http.StatusOK
+	if err != nil {
+		s.logger(fmt.Sprintf("could not import snapshot (%v)", err))
+		report.Error = err.Error()
+		status = http.StatusBadRequest
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) || errors.Is(err, snapshot.ErrTooLarge) {
+			status = http.StatusRequestEntityTooLarge
+		}
+	}
+	s.logger(fmt.Sprintf("imported snapshot: %d entries imported, %d evicted, %d failed", report.Imported, report.Evicted, report.Failed))
+
+	v, err := json.Marshal(report)
+	if err != nil {
+		s.logger(fmt.Sprintf("could not marshal response (%v)", err))
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(status)
+	resp.Write(v)
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"github.com/donutloop/httpcache/internal/cache"
 	"net/http"
+	"sync/atomic"
 	"time"
 )
 
@@ -20,9 +21,20 @@ type StatsResponse struct {
 	Size     int64     `json:"size"`
 	Capacity int64     `json:"capacity"`
 	Oldest   time.Time `json:"oldest"`
+
+	Tunnels        int64   `json:"tunnels"`
+	TunnelBytesIn  int64   `json:"tunnel_bytes_in"`
+	TunnelBytesOut int64   `json:"tunnel_bytes_out"`
+	TunnelSeconds  float64 `json:"tunnel_seconds"`
 }
 
 type Stats struct {
+	// counters of the CONNECT tunnels, first for the 64-bit alignment of atomics
+	tunnels        int64
+	tunnelBytesIn  int64
+	tunnelBytesOut int64
+	tunnelDuration int64
+
 	c      *cache.LRUCache
 	logger func(v ...interface{})
 }
@@ -47,11 +59,24 @@ func (s *Stats) Endpoint() *StatsResponse {
 	length, size, capacity, oldest := s.c.Stats()
 
 	resp := &StatsResponse{
-		Length:   length,
-		Size:     size,
-		Capacity: capacity,
-		Oldest:   oldest,
+		Length:         length,
+		Size:           size,
+		Capacity:       capacity,
+		Oldest:         oldest,
+		Tunnels:        atomic.LoadInt64(&s.tunnels),
+		TunnelBytesIn:  atomic.LoadInt64(&s.tunnelBytesIn),
+		TunnelBytesOut: atomic.LoadInt64(&s.tunnelBytesOut),
+		TunnelSeconds:  time.Duration(atomic.LoadInt64(&s.tunnelDuration)).Seconds(),
 	}
 
 	return resp
 }
+
+// recordTunnel counts a closed tunnel, the bytes sent by the client (in)
+// and by the upstream (out) and the time it was open.
+func (s *Stats) recordTunnel(in, out int64, d time.Duration) {
+	atomic.AddInt64(&s.tunnels, 1)
+	atomic.AddInt64(&s.tunnelBytesIn, in)
+	atomic.AddInt64(&s.tunnelBytesOut, out)
+	atomic.AddInt64(&s.tunnelDuration, int64(d))
+}
@@ -0,0 +1,83 @@
+package handler
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// streamConn is the client side of a CONNECT tunnel over HTTP/2, the request
+// body carries the bytes of the client and the response body those sent back.
+type streamConn struct {
+	body       io.ReadCloser
+	w          io.Writer
+	controller *http.ResponseController
+	local      net.Addr
+	remote     net.Addr
+}
+
+func newStreamConn(rw http.ResponseWriter, req *http.Request) *streamConn {
+	var local net.Addr = addr(req.Host)
+	if v, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		local = v
+	}
+	return &streamConn{
+		body:       req.Body,
+		w:          rw,
+		controller: http.NewResponseController(rw),
+		local:      local,
+		remote:     addr(req.RemoteAddr),
+	}
+}
+
+func (c *streamConn) Read(p []byte) (int, error) {
+	return c.body.Read(p)
+}
+
+func (c *streamConn) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, c.controller.Flush()
+}
+
+// Close ends the client side, the stream itself ends once the handler returns.
+func (c *streamConn) Close() error {
+	return c.body.Close()
+}
+
+func (c *streamConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *streamConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *streamConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+func (c *streamConn) SetReadDeadline(t time.Time) error {
+	return c.controller.SetReadDeadline(t)
+}
+
+func (c *streamConn) SetWriteDeadline(t time.Time) error {
+	return c.controller.SetWriteDeadline(t)
+}
+
+// addr is the address of a stream.
+type addr string
+
+func (a addr) Network() string {
+	return "tcp"
+}
+
+func (a addr) String() string {
+	return string(a)
+}
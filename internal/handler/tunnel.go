@@ -0,0 +1,99 @@
+package handler
+
+import (
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Ports is a list of ports, it implements flag.Value with comma separated ports.
+type Ports []string
+
+func (p *Ports) String() string {
+	return strings.Join(*p, ",")
+}
+
+func (p *Ports) Set(value string) error {
+	*p = nil
+	for _, port := range strings.Split(value, ",") {
+		if port = strings.TrimSpace(port); port != "" {
+			*p = append(*p, port)
+		}
+	}
+	return nil
+}
+
+// Allows reports whether the port is in the list, an empty list allows all ports.
+func (p Ports) Allows(port string) bool {
+	if len(p) == 0 {
+		return true
+	}
+	for _, v := range p {
+		if v == port {
+			return true
+		}
+	}
+	return false
+}
+
+// tunnel splices the client and upstream connection of a CONNECT request or
+// a protocol upgrade.
+type tunnel struct {
+	client      net.Conn
+	upstream    io.ReadWriteCloser
+	idleTimeout time.Duration
+}
+
+// splice copies in both directions until one side closes or the tunnel is
+// idle, it returns the bytes sent by the client and by the upstream.
+func (t *tunnel) splice() (in, out int64) {
+	t.touch()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		out = t.copy(t.client, t.upstream)
+	}()
+	in = t.copy(t.upstream, t.client)
+	wg.Wait()
+	return in, out
+}
+
+func (t *tunnel) copy(dst io.Writer, src io.Reader) int64 {
+	n, _ := io.Copy(dst, &idleReader{conn: src, tunnel: t})
+	// unblock the other direction
+	t.client.Close()
+	t.upstream.Close()
+	return n
+}
+
+// touch extends the deadline of both connections, traffic in one direction
+// keeps the tunnel open.
+func (t *tunnel) touch() {
+	if t.idleTimeout <= 0 {
+		return
+	}
+	deadline := time.Now().Add(t.idleTimeout)
+	t.client.SetDeadline(deadline)
+	// the upgraded body of a response has no deadline, the one of the client
+	// closes both sides
+	if conn, ok := t.upstream.(net.Conn); ok {
+		conn.SetDeadline(deadline)
+	}
+}
+
+type idleReader struct {
+	conn   io.Reader
+	tunnel *tunnel
+}
+
+func (r *idleReader) Read(p []byte) (int, error) {
+	n, err := r.conn.Read(p)
+	if n > 0 {
+		r.tunnel.touch()
+	}
+	return n, err
+}
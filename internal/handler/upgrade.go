@@ -0,0 +1,130 @@
+package handler
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"github.com/donutloop/httpcache/internal/roundtripper"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// upgradeType returns the protocol the request or response switches to,
+// empty if it's no upgrade.
+func upgradeType(h http.Header) string {
+	if hasToken(h["Connection"], "upgrade") {
+		return h.Get("Upgrade")
+	}
+	return ""
+}
+
+// fromExtendedConnect translates the extended CONNECT (RFC 8441) of an HTTP/2
+// client to the HTTP/1.1 upgrade it stands for, the upstream is spoken to
+// with HTTP/1.1.
+func fromExtendedConnect(req *http.Request) *http.Request {
+	outreq := req.Clone(req.Context())
+	outreq.Method = http.MethodGet
+
+	protocol := outreq.Header.Get(":protocol")
+	outreq.Header.Del(":protocol")
+	outreq.Header.Set("Connection", "Upgrade")
+	outreq.Header.Set("Upgrade", protocol)
+	if strings.EqualFold(protocol, "websocket") && outreq.Header.Get("Sec-WebSocket-Key") == "" {
+		key := make([]byte, 16)
+		rand.Read(key)
+		outreq.Header.Set("Sec-WebSocket-Key", base64.StdEncoding.EncodeToString(key))
+	}
+	return outreq
+}
+
+// upgrade sends the upgrade request past the cache and splices the client
+// and upstream connection once the upstream switched protocols, other
+// responses are copied back as usual.
+func (p *Proxy) upgrade(rw http.ResponseWriter, req *http.Request) {
+	if _, ok := rw.(http.Hijacker); !ok && req.ProtoMajor < 2 {
+		p.logger("proxy upgrade error: http server does not support hijacker")
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	ctx := roundtripper.WithCachePolicy(req.Context(), &roundtripper.CachePolicy{NoCache: true})
+	outreq := outgoing(req).WithContext(ctx)
+	if req.ProtoMajor >= 2 {
+		// the body of the stream carries the connection once the upstream switched
+		outreq.Body = http.NoBody
+		outreq.ContentLength = 0
+	}
+	proxyResponse, err := p.client.Do(outreq)
+	if err != nil {
+		p.logger(fmt.Sprintf("proxy upgrade error: %v", err))
+		writeError(rw, err)
+		return
+	}
+
+	if proxyResponse.StatusCode != http.StatusSwitchingProtocols {
+		p.copyResponse(rw, req, proxyResponse)
+		return
+	}
+
+	upgrade := upgradeType(proxyResponse.Header)
+	upstream, ok := proxyResponse.Body.(io.ReadWriteCloser)
+	if !ok || !strings.EqualFold(upgrade, req.Header.Get("Upgrade")) {
+		p.logger(fmt.Sprintf("proxy upgrade error: upstream switched to %q instead of %q", upgrade, req.Header.Get("Upgrade")))
+		proxyResponse.Body.Close()
+		rw.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	incoming(proxyResponse)
+
+	var clientConn net.Conn
+	if req.ProtoMajor >= 2 {
+		// HTTP/2 confirms the extended CONNECT with 200
+		for k, vv := range proxyResponse.Header {
+			if k != "Sec-Websocket-Accept" {
+				rw.Header()[k] = vv
+			}
+		}
+		rw.WriteHeader(http.StatusOK)
+		conn := newStreamConn(rw, req)
+		if err := conn.controller.Flush(); err != nil {
+			p.logger(fmt.Sprintf("proxy upgrade error: %v", err))
+			upstream.Close()
+			return
+		}
+		clientConn = conn
+	} else {
+		conn, brw, err := rw.(http.Hijacker).Hijack()
+		if err != nil {
+			p.logger(fmt.Sprintf("proxy upgrade error: %v", err))
+			upstream.Close()
+			return
+		}
+
+		proxyResponse.Header.Set("Connection", "Upgrade")
+		proxyResponse.Header.Set("Upgrade", upgrade)
+		fmt.Fprintf(brw, "HTTP/1.1 %s\r\n", proxyResponse.Status)
+		proxyResponse.Header.Write(brw)
+		brw.WriteString("\r\n")
+		err = brw.Flush()
+		if err == nil && brw.Reader.Buffered() > 0 {
+			// bytes the client sent right after the request
+			buffered, _ := brw.Reader.Peek(brw.Reader.Buffered())
+			_, err = upstream.Write(buffered)
+		}
+		if err != nil {
+			p.logger(fmt.Sprintf("proxy upgrade error: %v", err))
+			conn.Close()
+			upstream.Close()
+			return
+		}
+		clientConn = conn
+	}
+
+	t := &tunnel{client: clientConn, upstream: upstream, idleTimeout: p.TunnelIdleTimeout}
+	start := time.Now()
+	in, out := t.splice()
+	p.logger(fmt.Sprintf("upgraded connection %s (%s) closed: %d bytes in, %d bytes out [%s]%s", req.URL.Host, req.Header.Get("Upgrade"), in, out, time.Since(start), user(req)))
+}
@@ -0,0 +1,50 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/donutloop/httpcache/internal/warmup"
+	"net/http"
+)
+
+func NewWarmup(warmer *warmup.Warmer, logger func(v ...interface{})) *Warmup {
+	return &Warmup{
+		warmer: warmer,
+		logger: logger,
+	}
+}
+
+// Warmup fetches the URLs of the POST body through the cache. The result of
+// each URL is streamed back as a JSON line as soon as it's fetched, the last
+// line is the report.
+type Warmup struct {
+	warmer *warmup.Warmer
+	logger func(v ...interface{})
+}
+
+func (s *Warmup) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		resp.Header().Set("Allow", http.MethodPost)
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	urls, err := warmup.ReadURLs(req.Body)
+	if err != nil {
+		s.logger(fmt.Sprintf("could not read warm-up urls (%v)", err))
+		resp.WriteHeader(http.StatusBadRequest)
+		resp.Write([]byte(err.Error()))
+		return
+	}
+
+	resp.Header().Set("Content-Type", "application/x-ndjson")
+	resp.WriteHeader(http.StatusOK)
+	controller := http.NewResponseController(resp)
+	encoder := json.NewEncoder(resp)
+
+	report := s.warmer.Warm(req.Context(), urls, func(done int, result *warmup.Result) {
+		encoder.Encode(result)
+		controller.Flush()
+	})
+	encoder.Encode(report)
+}
@@ -0,0 +1,319 @@
+package har
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"fmt"
+	"github.com/donutloop/httpcache/internal/cache"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// The types follow the HTTP Archive format 1.2, the arrays of the format are
+// never nil, so that they're encoded as [] instead of null.
+
+type HAR struct {
+	Log *Log `json:"log"`
+}
+
+type Log struct {
+	Version string   `json:"version"`
+	Creator *Creator `json:"creator"`
+	Entries []*Entry `json:"entries"`
+}
+
+type Creator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type Entry struct {
+	StartedDateTime time.Time `json:"startedDateTime"`
+	Time            float64   `json:"time"`
+	Request         *Request  `json:"request"`
+	Response        *Response `json:"response"`
+	Cache           struct{}  `json:"cache"`
+	Timings         *Timings  `json:"timings"`
+	Comment         string    `json:"comment,omitempty"`
+}
+
+type Request struct {
+	Method      string       `json:"method"`
+	URL         string       `json:"url"`
+	HTTPVersion string       `json:"httpVersion"`
+	Cookies     []*NameValue `json:"cookies"`
+	Headers     []*NameValue `json:"headers"`
+	QueryString []*NameValue `json:"queryString"`
+	HeadersSize int          `json:"headersSize"`
+	BodySize    int64        `json:"bodySize"`
+}
+
+type Response struct {
+	Status      int          `json:"status"`
+	StatusText  string       `json:"statusText"`
+	HTTPVersion string       `json:"httpVersion"`
+	Cookies     []*NameValue `json:"cookies"`
+	Headers     []*NameValue `json:"headers"`
+	Content     *Content     `json:"content"`
+	RedirectURL string       `json:"redirectURL"`
+	HeadersSize int          `json:"headersSize"`
+	BodySize    int64        `json:"bodySize"`
+}
+
+type Content struct {
+	Size        int64  `json:"size"`
+	Compression int64  `json:"compression,omitempty"`
+	MimeType    string `json:"mimeType"`
+	Text        string `json:"text,omitempty"`
+	Encoding    string `json:"encoding,omitempty"`
+	Comment     string `json:"comment,omitempty"`
+}
+
+type NameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// Timings are in milliseconds, -1 marks the phases which don't apply or
+// aren't known.
+type Timings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+	SSL     float64 `json:"ssl"`
+}
+
+// New returns an archive of the entries.
+func New(entries []*Entry) *HAR {
+	if entries == nil {
+		entries = []*Entry{}
+	}
+	return &HAR{Log: &Log{
+		Version: "1.2",
+		Creator: &Creator{Name: "httpcache", Version: "1.0"},
+		Entries: entries,
+	}}
+}
+
+// slicePart reports whether the item is one of the numbered slices of a
+// sliced object, which are cached under the key of the object and "/<n>".
+func slicePart(item cache.Item) bool {
+	i := strings.LastIndex(item.Key, "/")
+	if i < 0 || item.Value.SliceSize > 0 {
+		return false
+	}
+	_, err := strconv.ParseInt(item.Key[i+1:], 10, 64)
+	return err == nil
+}
+
+// FromCache returns the entries of the cached responses, from the least to
+// the most recently used one. The slices of sliced objects are left out, the
+// object is listed without content.
+func FromCache(items []cache.Item) []*Entry {
+	entries := make([]*Entry, 0, len(items))
+	for _, item := range items {
+		if slicePart(item) {
+			continue
+		}
+		value := item.Value
+		if value.Resp == nil {
+			continue
+		}
+
+		method := value.Method
+		if method == "" {
+			method = http.MethodGet
+		}
+		req := &Request{
+			Method:      method,
+			URL:         value.URL,
+			HTTPVersion: "HTTP/1.1",
+			Cookies:     []*NameValue{},
+			Headers:     []*NameValue{},
+			QueryString: queryString(value.URL),
+			HeadersSize: -1,
+			BodySize:    0,
+		}
+
+		body, compression := value.Body, int64(0)
+		if value.Encoding == "gzip" {
+			if decoded, err := gunzip(body); err == nil {
+				compression = int64(len(decoded) - len(body))
+				body = decoded
+			}
+		}
+		resp := response(value.Resp, body)
+		resp.BodySize = int64(len(value.Body))
+		resp.Content.Compression = compression
+		if value.SliceSize > 0 {
+			resp.Content.Size = value.Resp.ContentLength
+			resp.Content.Comment = fmt.Sprintf("cached in slices of %d bytes", value.SliceSize)
+		}
+
+		comment := "cached"
+		if !value.Expires.IsZero() {
+			comment = fmt.Sprintf("cached, expires %s", value.Expires.UTC().Format(time.RFC3339))
+		}
+		entries = append(entries, &Entry{
+			StartedDateTime: item.Accessed,
+			Request:         req,
+			Response:        resp,
+			Timings:         &Timings{Blocked: -1, DNS: -1, Connect: -1, SSL: -1},
+			Comment:         comment,
+		})
+	}
+	return entries
+}
+
+func request(req *http.Request) *Request {
+	bodySize := req.ContentLength
+	if bodySize < 0 {
+		bodySize = -1
+	}
+	return &Request{
+		Method:      req.Method,
+		URL:         req.URL.String(),
+		HTTPVersion: httpVersion(req.Proto),
+		Cookies:     cookies(req.Cookies()),
+		Headers:     headers(req.Header),
+		QueryString: queryString(req.URL.String()),
+		HeadersSize: -1,
+		BodySize:    bodySize,
+	}
+}
+
+// response returns the response with its body as content, the body is nil
+// if it isn't known.
+func response(resp *http.Response, body []byte) *Response {
+	return &Response{
+		Status:      resp.StatusCode,
+		StatusText:  http.StatusText(resp.StatusCode),
+		HTTPVersion: httpVersion(resp.Proto),
+		Cookies:     cookies(resp.Cookies()),
+		Headers:     headers(resp.Header),
+		Content:     content(resp.Header.Get("Content-Type"), body),
+		RedirectURL: resp.Header.Get("Location"),
+		HeadersSize: -1,
+		BodySize:    int64(len(body)),
+	}
+}
+
+func content(mimeType string, body []byte) *Content {
+	c := &Content{Size: int64(len(body)), MimeType: mimeType}
+	if len(body) == 0 {
+		return c
+	}
+	if textual(mimeType) && utf8.Valid(body) {
+		c.Text = string(body)
+	} else {
+		c.Text = base64.StdEncoding.EncodeToString(body)
+		c.Encoding = "base64"
+	}
+	return c
+}
+
+// textual reports whether the media type is text, the others are encoded
+// as base64.
+func textual(mimeType string) bool {
+	mediaType, _, err := mime.ParseMediaType(mimeType)
+	if err != nil {
+		return false
+	}
+	if strings.HasPrefix(mediaType, "text/") {
+		return true
+	}
+	for _, suffix := range []string{"json", "xml", "javascript", "x-www-form-urlencoded"} {
+		if strings.HasSuffix(mediaType, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// redacted replaces the values of credentials, so that archives can be
+// shared.
+const redacted = "[redacted]"
+
+// credentials are the headers whose values are redacted.
+var credentials = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"Cookie":              true,
+	"Set-Cookie":          true,
+}
+
+func headers(h http.Header) []*NameValue {
+	pairs := []*NameValue{}
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, v := range h[name] {
+			if credentials[http.CanonicalHeaderKey(name)] {
+				v = redacted
+			}
+			pairs = append(pairs, &NameValue{Name: name, Value: v})
+		}
+	}
+	return pairs
+}
+
+func cookies(cs []*http.Cookie) []*NameValue {
+	pairs := []*NameValue{}
+	for _, c := range cs {
+		pairs = append(pairs, &NameValue{Name: c.Name, Value: redacted})
+	}
+	return pairs
+}
+
+func queryString(rawURL string) []*NameValue {
+	pairs := []*NameValue{}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return pairs
+	}
+	query := u.Query()
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, v := range query[name] {
+			pairs = append(pairs, &NameValue{Name: name, Value: v})
+		}
+	}
+	return pairs
+}
+
+func httpVersion(proto string) string {
+	if proto == "" {
+		return "HTTP/1.1"
+	}
+	return proto
+}
+
+func gunzip(body []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
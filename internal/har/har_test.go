@@ -0,0 +1,144 @@
+package har
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"github.com/donutloop/httpcache/internal/cache"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func exchange(t *testing.T, r *Recorder, url, body string) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Proto:      "HTTP/1.1",
+		Header:     http.Header{"Content-Type": {"text/plain"}},
+		Body:       ioutil.NopCloser(strings.NewReader(body)),
+	}
+	r.Record(req, resp, time.Now().Add(-5*time.Millisecond), 5*time.Millisecond)
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+}
+
+func TestRecorder(t *testing.T) {
+	r := NewRecorder(2, 4)
+
+	exchange(t, r, "http://example.com/a?x=1", "a")
+	exchange(t, r, "http://example.com/b", "b")
+	exchange(t, r, "http://example.com/c", "long body")
+
+	entries := r.Entries()
+	if len(entries) != 2 || entries[0].Request.URL != "http://example.com/b" || entries[1].Request.URL != "http://example.com/c" {
+		t.Fatalf("entries are bad, got=%v", entries)
+	}
+
+	content := entries[1].Response.Content
+	if content.Text != "long" || content.Size != 9 || content.Comment != "body is truncated" {
+		t.Fatalf("content is bad, got=%#v", content)
+	}
+	if entries[1].Timings.Wait != 5 || entries[1].Time < 5 {
+		t.Fatalf("timings are bad, got=%#v", entries[1].Timings)
+	}
+}
+
+func TestFromCache(t *testing.T) {
+	var body bytes.Buffer
+	w := gzip.NewWriter(&body)
+	w.Write([]byte(`{"ok":true}`))
+	w.Close()
+
+	items := []cache.Item{
+		{
+			Key: "a",
+			Value: cache.CachedResponse{
+				Resp:     &http.Response{StatusCode: http.StatusOK, Proto: "HTTP/1.1", Header: http.Header{"Content-Type": {"application/json"}}},
+				Body:     body.Bytes(),
+				URL:      "http://example.com/a?x=1",
+				Encoding: "gzip",
+			},
+			Accessed: time.Now(),
+		},
+		{Key: "a/0", Value: cache.CachedResponse{Resp: &http.Response{StatusCode: http.StatusOK}}},
+		{Key: "c/0", Value: cache.CachedResponse{Resp: &http.Response{StatusCode: http.StatusOK}, Body: []byte("01234")}},
+		{Key: "c/1", Value: cache.CachedResponse{Resp: &http.Response{StatusCode: http.StatusOK}, Body: []byte("56789")}},
+		{
+			Key: "c/slices",
+			Value: cache.CachedResponse{
+				Resp:      &http.Response{StatusCode: http.StatusOK, Header: http.Header{"Content-Type": {"video/mp4"}}, ContentLength: 10},
+				URL:       "http://example.com/c.mp4",
+				SliceSize: 5,
+			},
+		},
+		{
+			Key: "b",
+			Value: cache.CachedResponse{
+				Resp: &http.Response{StatusCode: http.StatusOK, Header: http.Header{"Content-Type": {"image/png"}}},
+				Body: []byte{0x89, 'P', 'N', 'G'},
+				URL:  "http://example.com/b.png",
+			},
+		},
+	}
+
+	entries := FromCache(items)
+	if len(entries) != 3 {
+		t.Fatalf("entries are bad, got=%d", len(entries))
+	}
+
+	a := entries[0]
+	if a.Request.Method != http.MethodGet || a.Request.QueryString[0].Value != "1" || a.Response.Content.Text != `{"ok":true}` {
+		t.Fatalf("entry is bad, got=%#v", a.Response.Content)
+	}
+
+	c := entries[1]
+	if c.Request.URL != "http://example.com/c.mp4" || c.Response.Content.Size != 10 || !strings.Contains(c.Response.Content.Comment, "slices of 5 bytes") {
+		t.Fatalf("entry is bad, got=%#v", c.Response.Content)
+	}
+
+	b := entries[2]
+	if b.Response.Content.Encoding != "base64" || b.Response.Content.Text != "iVBORw==" {
+		t.Fatalf("entry is bad, got=%#v", b.Response.Content)
+	}
+
+	v, err := json.Marshal(New(entries))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(v), `"version":"1.2"`) || strings.Contains(string(v), "null") {
+		t.Fatalf("archive is bad, got=%s", v)
+	}
+}
+
+func TestRequest_Redacted(t *testing.T) {
+	req, err := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer s3cr3t")
+	req.Header.Set("Cookie", "session=s3cr3t")
+	req.Header.Set("Accept", "text/plain")
+
+	encoded, err := json.Marshal(request(req))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(encoded, []byte("s3cr3t")) || !bytes.Contains(encoded, []byte("text/plain")) {
+		t.Fatalf("request is bad, got=%s", encoded)
+	}
+
+	resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{"Set-Cookie": {"session=s3cr3t; Path=/"}}}
+	encoded, err = json.Marshal(response(resp, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(encoded, []byte("s3cr3t")) || !bytes.Contains(encoded, []byte(`"name":"session"`)) {
+		t.Fatalf("response is bad, got=%s", encoded)
+	}
+}
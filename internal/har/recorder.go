@@ -0,0 +1,135 @@
+package har
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Recorder keeps the most recent exchanges of the proxy in a ring, the
+// oldest exchange is dropped for a new one once it's full.
+type Recorder struct {
+	// BodyLimit is the number of body bytes which are kept per response,
+	// longer bodies are truncated and zero keeps no bodies.
+	BodyLimit int64
+
+	mu      sync.Mutex
+	entries []*Entry
+	next    int
+	full    bool
+}
+
+// NewRecorder creates a recorder of the last size exchanges.
+func NewRecorder(size int, bodyLimit int64) *Recorder {
+	return &Recorder{
+		BodyLimit: bodyLimit,
+		entries:   make([]*Entry, size),
+	}
+}
+
+// Record adds the exchange once the body of the response is read or closed,
+// wait is the time until the response headers arrived. The body of the
+// response is replaced.
+func (r *Recorder) Record(req *http.Request, resp *http.Response, start time.Time, wait time.Duration) {
+	entry := &Entry{
+		StartedDateTime: start,
+		Request:         request(req),
+		Response:        response(resp, nil),
+		Timings:         &Timings{Blocked: -1, DNS: -1, Connect: -1, SSL: -1, Wait: milliseconds(wait)},
+	}
+
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		// the body of an upgraded connection is left alone
+		entry.Time = milliseconds(wait)
+		r.add(entry)
+		return
+	}
+
+	resp.Body = &recordedBody{
+		ReadCloser: resp.Body,
+		recorder:   r,
+		entry:      entry,
+		mimeType:   resp.Header.Get("Content-Type"),
+		headersAt:  start.Add(wait),
+	}
+}
+
+// Entries returns the recorded exchanges, the oldest first.
+func (r *Recorder) Entries() []*Entry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var entries []*Entry
+	if r.full {
+		entries = append(entries, r.entries[r.next:]...)
+	}
+	return append(entries, r.entries[:r.next]...)
+}
+
+func (r *Recorder) add(entry *Entry) {
+	if len(r.entries) == 0 {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries[r.next] = entry
+	r.next++
+	if r.next == len(r.entries) {
+		r.next = 0
+		r.full = true
+	}
+}
+
+// recordedBody completes the entry with the body, at the end of the body or
+// when it's closed.
+type recordedBody struct {
+	io.ReadCloser
+	recorder  *Recorder
+	entry     *Entry
+	mimeType  string
+	headersAt time.Time
+
+	body bytes.Buffer
+	size int64
+	once sync.Once
+}
+
+func (b *recordedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.size += int64(n)
+	if keep := b.recorder.BodyLimit - int64(b.body.Len()); keep > 0 {
+		if int64(n) < keep {
+			keep = int64(n)
+		}
+		b.body.Write(p[:keep])
+	}
+	if err == io.EOF {
+		b.done()
+	}
+	return n, err
+}
+
+func (b *recordedBody) Close() error {
+	b.done()
+	return b.ReadCloser.Close()
+}
+
+func (b *recordedBody) done() {
+	b.once.Do(func() {
+		receive := time.Since(b.headersAt)
+		if receive < 0 {
+			receive = 0
+		}
+		b.entry.Timings.Receive = milliseconds(receive)
+		b.entry.Time = b.entry.Timings.Wait + b.entry.Timings.Receive
+		b.entry.Response.BodySize = b.size
+		b.entry.Response.Content = content(b.mimeType, b.body.Bytes())
+		b.entry.Response.Content.Size = b.size
+		if int64(b.body.Len()) < b.size {
+			b.entry.Response.Content.Comment = "body is truncated"
+		}
+		b.recorder.add(b.entry)
+	})
+}
@@ -0,0 +1,36 @@
+package middleware
+
+import (
+	"fmt"
+	"github.com/donutloop/httpcache/internal/acl"
+	"net/http"
+)
+
+// ReasonHeader carries the reason of a denied request.
+const ReasonHeader = "X-Proxy-Deny-Reason"
+
+func NewACL(next http.Handler, list *acl.List, loggerFunc func(v ...interface{})) *ACL {
+	return &ACL{
+		Next:       next,
+		List:       list,
+		loggerFunc: loggerFunc,
+	}
+}
+
+// ACL answers the requests which the access control list denies with 403,
+// proxied requests and CONNECT tunnels alike.
+type ACL struct {
+	Next       http.Handler
+	List       *acl.List
+	loggerFunc func(v ...interface{})
+}
+
+func (h *ACL) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if ok, reason := h.List.Evaluate(req); !ok {
+		h.loggerFunc(fmt.Sprintf("access of %s to %s %s is denied (%s)", req.RemoteAddr, req.Method, req.Host, reason))
+		w.Header().Set(ReasonHeader, reason)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	h.Next.ServeHTTP(w, req)
+}
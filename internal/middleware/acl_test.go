@@ -0,0 +1,34 @@
+package middleware
+
+import (
+	"github.com/donutloop/httpcache/internal/acl"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestACL(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	list := &acl.List{Rules: []*acl.Rule{{Action: acl.Deny, Ports: []string{"25"}, Reason: "smtp is blocked"}}}
+	if err := list.Init(); err != nil {
+		t.Fatal(err)
+	}
+	middleware := NewACL(next, list, t.Log)
+
+	resp := httptest.NewRecorder()
+	middleware.ServeHTTP(resp, httptest.NewRequest(http.MethodConnect, "mail.example.com:25", nil))
+
+	if resp.Code != http.StatusForbidden || resp.Header().Get(ReasonHeader) != "smtp is blocked" {
+		t.Fatalf("response is bad, got=(%d, %s)", resp.Code, resp.Header().Get(ReasonHeader))
+	}
+
+	resp = httptest.NewRecorder()
+	middleware.ServeHTTP(resp, httptest.NewRequest(http.MethodConnect, "www.example.com:443", nil))
+
+	if resp.Code != http.StatusOK {
+		t.Fatalf("status code is bad (%v)", resp.Code)
+	}
+}
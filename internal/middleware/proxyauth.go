@@ -0,0 +1,75 @@
+package middleware
+
+import (
+	"fmt"
+	"github.com/donutloop/httpcache/internal/auth"
+	"github.com/donutloop/httpcache/internal/ratelimit"
+	"github.com/donutloop/httpcache/internal/route"
+	"net/http"
+)
+
+func NewProxyAuth(next http.Handler, authenticator *auth.Authenticator, loggerFunc func(v ...interface{})) *ProxyAuth {
+	return &ProxyAuth{
+		Next:          next,
+		Authenticator: authenticator,
+		loggerFunc:    loggerFunc,
+	}
+}
+
+// ProxyAuth requires the clients of the forward proxy to authenticate with
+// the Proxy-Authorization header, CONNECT included. Requests to the routes
+// of the reverse proxy aren't affected.
+type ProxyAuth struct {
+	Next          http.Handler
+	Authenticator *auth.Authenticator
+
+	// Routes of the reverse proxy, HTTP/2 requests which match none of them
+	// are forward proxy requests.
+	Routes route.Table
+
+	// Failures limits the failed authentications per client IP (optional),
+	// clients over the limit are answered with 429 before their
+	// credentials are checked.
+	Failures *ratelimit.Limiter
+
+	loggerFunc func(v ...interface{})
+}
+
+func (h *ProxyAuth) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	// the proxy decides by the same target whether it forwards the request
+	forward := h.Routes.Absolute(req).URL.IsAbs() || (req.Method == http.MethodConnect && req.Header.Get(":protocol") == "")
+	// the requests of intercepted tunnels carry the identity of their CONNECT
+	if !forward || auth.Identity(req.Context()) != "" {
+		h.Next.ServeHTTP(w, req)
+		return
+	}
+
+	// no identity is set, so the key is the IP address of the client
+	key := ratelimit.Key(req)
+	if h.Failures != nil {
+		if ok, retryAfter := h.Failures.Available(key); !ok {
+			err := &ratelimit.Error{RetryAfter: retryAfter}
+			h.loggerFunc(fmt.Sprintf("proxy authentication of %s is limited (%v)", key, err))
+			w.Header().Set("Retry-After", err.RetryAfterSeconds())
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+	}
+
+	identity, ok := h.Authenticator.Authenticate(req)
+	if !ok {
+		if req.Header.Get("Proxy-Authorization") != "" {
+			h.loggerFunc(fmt.Sprintf("proxy authentication of %s failed (%s %s)", req.RemoteAddr, req.Method, req.Host))
+			if h.Failures != nil {
+				h.Failures.Allow(key)
+			}
+		}
+		for _, challenge := range h.Authenticator.Challenges() {
+			w.Header().Add("Proxy-Authenticate", challenge)
+		}
+		w.WriteHeader(http.StatusProxyAuthRequired)
+		return
+	}
+
+	h.Next.ServeHTTP(w, req.WithContext(auth.WithIdentity(req.Context(), identity)))
+}
@@ -0,0 +1,141 @@
+package middleware
+
+import (
+	"github.com/donutloop/httpcache/internal/auth"
+	"github.com/donutloop/httpcache/internal/ratelimit"
+	"github.com/donutloop/httpcache/internal/route"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestProxyAuth(t *testing.T) {
+	var identity string
+	next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		identity = auth.Identity(req.Context())
+		w.WriteHeader(http.StatusOK)
+	})
+
+	middleware := NewProxyAuth(next, &auth.Authenticator{
+		Users:  auth.Htpasswd{"alice": "{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ="},
+		Tokens: auth.Tokens{"s3cr3t": "ci"},
+		Realm:  "httpcache",
+	}, t.Log)
+
+	tests := []struct {
+		method, target, authorization string
+		status                        int
+		identity                      string
+	}{
+		{http.MethodGet, "http://example.com/", "", http.StatusProxyAuthRequired, ""},
+		{http.MethodGet, "http://example.com/", "Basic YWxpY2U6c2VjcmV0", http.StatusOK, "alice"},
+		{http.MethodGet, "http://example.com/", "Basic YWxpY2U6d3Jvbmc=", http.StatusProxyAuthRequired, ""},
+		{http.MethodConnect, "example.com:443", "", http.StatusProxyAuthRequired, ""},
+		{http.MethodConnect, "example.com:443", "Bearer s3cr3t", http.StatusOK, "ci"},
+		{http.MethodGet, "/v1/items", "", http.StatusOK, ""},
+	}
+
+	for _, test := range tests {
+		identity = ""
+		req := httptest.NewRequest(test.method, test.target, nil)
+		if test.authorization != "" {
+			req.Header.Set("Proxy-Authorization", test.authorization)
+		}
+		resp := httptest.NewRecorder()
+
+		middleware.ServeHTTP(resp, req)
+
+		if resp.Code != test.status || identity != test.identity {
+			t.Fatalf("response of %s %s is bad, got=(%d, %q)", test.method, test.target, resp.Code, identity)
+		}
+		if resp.Code == http.StatusProxyAuthRequired && len(resp.Header()["Proxy-Authenticate"]) != 2 {
+			t.Fatalf("challenges are bad, got=%v", resp.Header()["Proxy-Authenticate"])
+		}
+	}
+}
+
+func TestProxyAuth_Failures(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	middleware := NewProxyAuth(next, &auth.Authenticator{
+		Users: auth.Htpasswd{"alice": "{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ="},
+		Realm: "httpcache",
+	}, t.Log)
+	{
+		middleware.Failures = ratelimit.NewLimiter(1.0/60, 3)
+	}
+
+	do := func(authorization, remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req.RemoteAddr = remoteAddr
+		if authorization != "" {
+			req.Header.Set("Proxy-Authorization", authorization)
+		}
+		resp := httptest.NewRecorder()
+		middleware.ServeHTTP(resp, req)
+		return resp
+	}
+
+	// the challenge without credentials isn't a failure
+	if resp := do("", "192.0.2.1:1234"); resp.Code != http.StatusProxyAuthRequired {
+		t.Fatalf("status code is bad (%v)", resp.Code)
+	}
+	for i := 0; i < 3; i++ {
+		if resp := do("Basic YWxpY2U6d3Jvbmc=", "192.0.2.1:1234"); resp.Code != http.StatusProxyAuthRequired {
+			t.Fatalf("status code of attempt %d is bad (%v)", i, resp.Code)
+		}
+	}
+
+	// the right password doesn't help once the client is limited
+	resp := do("Basic YWxpY2U6c2VjcmV0", "192.0.2.1:4321")
+	if resp.Code != http.StatusTooManyRequests || resp.Header().Get("Retry-After") == "" {
+		t.Fatalf("response is bad, got=(%d, %q)", resp.Code, resp.Header().Get("Retry-After"))
+	}
+
+	if resp := do("Basic YWxpY2U6c2VjcmV0", "192.0.2.2:1234"); resp.Code != http.StatusOK {
+		t.Fatalf("status code of other client is bad (%v)", resp.Code)
+	}
+}
+
+func TestProxyAuth_HTTP2(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	middleware := NewProxyAuth(next, &auth.Authenticator{
+		Tokens: auth.Tokens{"s3cr3t": "ci"},
+		Realm:  "httpcache",
+	}, t.Log)
+	{
+		middleware.Routes = route.Table{
+			{Host: "api.example.com", Prefix: "/v1/", Upstream: "http://127.0.0.1:8080"},
+		}
+		if err := middleware.Routes.Init(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		host   string
+		status int
+	}{
+		{"example.com", http.StatusProxyAuthRequired},
+		{"api.example.com", http.StatusOK},
+	}
+
+	for _, test := range tests {
+		// the HTTP/2 server passes the authority of forward proxy requests in the Host field
+		req := httptest.NewRequest(http.MethodGet, "/v1/items", nil)
+		req.Proto, req.ProtoMajor, req.ProtoMinor = "HTTP/2.0", 2, 0
+		req.Host = test.host
+		resp := httptest.NewRecorder()
+
+		middleware.ServeHTTP(resp, req)
+
+		if resp.Code != test.status {
+			t.Fatalf("status code of %s is bad, got=%d", test.host, resp.Code)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package middleware
+
+import (
+	"fmt"
+	"github.com/donutloop/httpcache/internal/ratelimit"
+	"net/http"
+)
+
+func NewRateLimit(next http.Handler, requests *ratelimit.Limiter, concurrency *ratelimit.Concurrency, loggerFunc func(v ...interface{})) *RateLimit {
+	return &RateLimit{
+		Next:        next,
+		Requests:    requests,
+		Concurrency: concurrency,
+		loggerFunc:  loggerFunc,
+	}
+}
+
+// RateLimit limits the request rate and the concurrent requests of each
+// client, the client is the authenticated user or else the IP address.
+// Requests over the limit are answered with 429. The client key is passed on
+// in the context, for the budget of the cache misses.
+type RateLimit struct {
+	Next        http.Handler
+	Requests    *ratelimit.Limiter     // optional
+	Concurrency *ratelimit.Concurrency // optional
+	loggerFunc  func(v ...interface{})
+}
+
+func (h *RateLimit) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	key := ratelimit.Key(req)
+
+	if h.Requests != nil {
+		if ok, retryAfter := h.Requests.Allow(key); !ok {
+			h.reject(w, key, &ratelimit.Error{RetryAfter: retryAfter})
+			return
+		}
+	}
+
+	// the requests of intercepted tunnels carry the client key of their
+	// CONNECT, which holds the slot of the client
+	_, tunneled := ratelimit.KeyOf(req.Context())
+	if h.Concurrency != nil && !tunneled {
+		if !h.Concurrency.Acquire(key) {
+			h.reject(w, key, &ratelimit.Error{RetryAfter: 1})
+			return
+		}
+		defer h.Concurrency.Release(key)
+	}
+
+	h.Next.ServeHTTP(w, req.WithContext(ratelimit.WithKey(req.Context(), key)))
+}
+
+func (h *RateLimit) reject(w http.ResponseWriter, key string, err *ratelimit.Error) {
+	h.loggerFunc(fmt.Sprintf("client %s is limited (%v)", key, err))
+	w.Header().Set("Retry-After", err.RetryAfterSeconds())
+	w.WriteHeader(http.StatusTooManyRequests)
+}
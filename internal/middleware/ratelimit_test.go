@@ -0,0 +1,103 @@
+package middleware
+
+import (
+	"github.com/donutloop/httpcache/internal/ratelimit"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRateLimit(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	middleware := NewRateLimit(next, ratelimit.NewLimiter(1, 2), nil, t.Log)
+
+	for i := 0; i < 2; i++ {
+		resp := httptest.NewRecorder()
+		middleware.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+		if resp.Code != http.StatusOK {
+			t.Fatalf("status code is bad (%v)", resp.Code)
+		}
+	}
+
+	resp := httptest.NewRecorder()
+	middleware.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+	if resp.Code != http.StatusTooManyRequests || resp.Header().Get("Retry-After") != "1" {
+		t.Fatalf("response is bad, got=(%d, %s)", resp.Code, resp.Header().Get("Retry-After"))
+	}
+
+	// other clients have their own budget
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.RemoteAddr = "192.0.2.2:1234"
+	resp = httptest.NewRecorder()
+	middleware.ServeHTTP(resp, req)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("status code is bad (%v)", resp.Code)
+	}
+}
+
+func TestRateLimit_Concurrency(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		started <- struct{}{}
+		<-release
+		w.WriteHeader(http.StatusOK)
+	})
+
+	middleware := NewRateLimit(next, nil, ratelimit.NewConcurrency(1), t.Log)
+
+	done := make(chan int)
+	go func() {
+		resp := httptest.NewRecorder()
+		middleware.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+		done <- resp.Code
+	}()
+	<-started
+
+	resp := httptest.NewRecorder()
+	middleware.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+	if resp.Code != http.StatusTooManyRequests {
+		t.Fatalf("status code is bad (%v)", resp.Code)
+	}
+
+	close(release)
+	if code := <-done; code != http.StatusOK {
+		t.Fatalf("status code is bad (%v)", code)
+	}
+
+	go func() { <-started }()
+	resp = httptest.NewRecorder()
+	middleware.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+	if resp.Code != http.StatusOK {
+		t.Fatalf("status code is bad (%v)", resp.Code)
+	}
+}
+
+func TestRateLimit_Tunneled(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	concurrency := ratelimit.NewConcurrency(1)
+	middleware := NewRateLimit(next, nil, concurrency, t.Log)
+
+	// the CONNECT of the tunnel holds the slot of the client
+	concurrency.Acquire("192.0.2.1")
+	defer concurrency.Release("192.0.2.1")
+
+	req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+	resp := httptest.NewRecorder()
+	middleware.ServeHTTP(resp, req.WithContext(ratelimit.WithKey(req.Context(), "192.0.2.1")))
+	if resp.Code != http.StatusOK {
+		t.Fatalf("status code is bad (%v)", resp.Code)
+	}
+
+	resp = httptest.NewRecorder()
+	middleware.ServeHTTP(resp, req)
+	if resp.Code != http.StatusTooManyRequests {
+		t.Fatalf("status code is bad (%v)", resp.Code)
+	}
+}
@@ -0,0 +1,207 @@
+package mitm
+
+import (
+	"container/list"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CertStore mints certificates for intercepted hosts on the fly, they are
+// signed by the configured local CA and kept for later connections. The least
+// recently used certificates are dropped once Capacity is reached.
+type CertStore struct {
+	// Capacity is the number of certificates which are kept.
+	Capacity int
+
+	ca    *x509.Certificate
+	caKey crypto.Signer
+	key   *ecdsa.PrivateKey // shared key of all minted certificates
+
+	mu    sync.Mutex
+	certs map[string]*list.Element
+	lru   *list.List // of *storedCert, the most recently used first
+}
+
+type storedCert struct {
+	host string
+	cert *tls.Certificate
+}
+
+// NewCertStore creates a store which signs with the CA certificate and key.
+func NewCertStore(ca tls.Certificate) (*CertStore, error) {
+	if len(ca.Certificate) == 0 {
+		return nil, errors.New("ca has no certificate")
+	}
+	caCert, err := x509.ParseCertificate(ca.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	if !caCert.IsCA {
+		return nil, errors.New("ca certificate is not a certificate authority")
+	}
+	caKey, ok := ca.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("ca key can't sign")
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CertStore{
+		Capacity: 1000,
+		ca:       caCert,
+		caKey:    caKey,
+		key:      key,
+		certs:    make(map[string]*list.Element),
+		lru:      list.New(),
+	}, nil
+}
+
+// Certificate returns the certificate of the host, it's minted on the first call.
+func (s *CertStore) Certificate(host string) (*tls.Certificate, error) {
+	host = strings.ToLower(host)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if element, ok := s.certs[host]; ok {
+		stored := element.Value.(*storedCert)
+		if time.Now().Before(stored.cert.Leaf.NotAfter) {
+			s.lru.MoveToFront(element)
+			return stored.cert, nil
+		}
+		s.lru.Remove(element)
+		delete(s.certs, host)
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	notAfter := time.Now().AddDate(1, 0, 0)
+	if notAfter.After(s.ca.NotAfter) {
+		notAfter = s.ca.NotAfter
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{host}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, s.ca, &s.key.PublicKey, s.caKey)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	cert := &tls.Certificate{
+		Certificate: [][]byte{der, s.ca.Raw},
+		PrivateKey:  s.key,
+		Leaf:        leaf,
+	}
+	s.certs[host] = s.lru.PushFront(&storedCert{host: host, cert: cert})
+	for s.Capacity > 0 && s.lru.Len() > s.Capacity {
+		oldest := s.lru.Back()
+		s.lru.Remove(oldest)
+		delete(s.certs, oldest.Value.(*storedCert).host)
+	}
+	return cert, nil
+}
+
+// Hosts is a list of host patterns like "*.example.com", it implements
+// flag.Value with comma separated patterns.
+type Hosts []string
+
+func (h *Hosts) String() string {
+	return strings.Join(*h, ",")
+}
+
+func (h *Hosts) Set(value string) error {
+	for _, pattern := range strings.Split(value, ",") {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if pattern == "" {
+			continue
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return err
+		}
+		*h = append(*h, pattern)
+	}
+	return nil
+}
+
+// Match reports whether the host matches one of the patterns.
+func (h Hosts) Match(host string) bool {
+	host = strings.ToLower(host)
+	for _, pattern := range h {
+		if ok, _ := path.Match(pattern, host); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Interceptor decides which CONNECT tunnels are intercepted, the others are
+// tunneled untouched.
+type Interceptor struct {
+	Certs *CertStore
+
+	// Intercept lists the intercepted hosts, empty intercepts all hosts.
+	Intercept Hosts
+
+	// Tunnel lists the hosts which are never intercepted, e.g. hosts which
+	// pin their certificates.
+	Tunnel Hosts
+}
+
+// Intercepts reports whether the CONNECT tunnel to the host is intercepted.
+func (i *Interceptor) Intercepts(host string) bool {
+	if i == nil || i.Certs == nil || i.Tunnel.Match(host) {
+		return false
+	}
+	return len(i.Intercept) == 0 || i.Intercept.Match(host)
+}
+
+// TLSConfig returns the server configuration of intercepted connections to
+// the CONNECT host. The certificate is minted for the host only, handshakes
+// with another SNI are refused, so that clients can't mint certificates for
+// arbitrary names.
+func (i *Interceptor) TLSConfig(host string) *tls.Config {
+	return &tls.Config{
+		NextProtos: []string{"h2", "http/1.1"},
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if hello.ServerName != "" && !strings.EqualFold(hello.ServerName, host) {
+				return nil, fmt.Errorf("server name %q doesn't match the CONNECT host %q", hello.ServerName, host)
+			}
+			return i.Certs.Certificate(host)
+		},
+	}
+}
@@ -0,0 +1,135 @@
+package mitm
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func newCertStore(t *testing.T) *CertStore {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "httpcache test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certs, err := NewCertStore(tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certs
+}
+
+func TestCertStore(t *testing.T) {
+	certs := newCertStore(t)
+
+	cert, err := certs.Certificate("api.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(certs.ca)
+	if _, err := cert.Leaf.Verify(x509.VerifyOptions{DNSName: "api.example.com", Roots: roots}); err != nil {
+		t.Fatal(err)
+	}
+
+	again, err := certs.Certificate("API.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != cert {
+		t.Fatal("certificate is minted twice")
+	}
+}
+
+func TestCertStore_Capacity(t *testing.T) {
+	certs := newCertStore(t)
+	certs.Capacity = 2
+
+	first, err := certs.Certificate("a.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, host := range []string{"b.example.com", "c.example.com"} {
+		if _, err := certs.Certificate(host); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(certs.certs) != 2 || certs.lru.Len() != 2 {
+		t.Fatalf("certificates are bad, got=%d", len(certs.certs))
+	}
+	again, err := certs.Certificate("a.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again == first {
+		t.Fatal("least recently used certificate is kept")
+	}
+}
+
+func TestInterceptor_TLSConfig(t *testing.T) {
+	interceptor := &Interceptor{Certs: newCertStore(t)}
+	config := interceptor.TLSConfig("api.example.com")
+
+	if _, err := config.GetCertificate(&tls.ClientHelloInfo{ServerName: "API.example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := config.GetCertificate(&tls.ClientHelloInfo{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := config.GetCertificate(&tls.ClientHelloInfo{ServerName: "other.example.com"}); err == nil {
+		t.Fatal("certificate is minted for another server name")
+	}
+	if len(interceptor.Certs.certs) != 1 {
+		t.Fatalf("certificates are bad, got=%d", len(interceptor.Certs.certs))
+	}
+}
+
+func TestInterceptor_Intercepts(t *testing.T) {
+	interceptor := &Interceptor{Certs: &CertStore{}}
+	if err := interceptor.Intercept.Set("*.example.com, example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if err := interceptor.Tunnel.Set("login.example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]bool{
+		"api.example.com":   true,
+		"example.org":       true,
+		"login.example.com": false,
+		"example.net":       false,
+	}
+
+	for host, want := range tests {
+		if got := interceptor.Intercepts(host); got != want {
+			t.Errorf("interception of %s is bad, got=%v", host, got)
+		}
+	}
+
+	var disabled *Interceptor
+	if disabled.Intercepts("api.example.com") {
+		t.Error("nil interceptor intercepts")
+	}
+}
@@ -0,0 +1,254 @@
+package parentproxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// dialConnect opens a tunnel to the address through an HTTP or HTTPS proxy.
+func (c *Config) dialConnect(ctx context.Context, proxy *url.URL, addr string) (net.Conn, error) {
+	conn, err := c.dial(ctx, "tcp", proxyAddr(proxy))
+	if err != nil {
+		return nil, err
+	}
+
+	if proxy.Scheme == "https" {
+		conn = tls.Client(conn, &tls.Config{ServerName: proxy.Hostname()})
+	}
+
+	done := handshakeDeadline(ctx, conn)
+	defer done()
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if proxy.User != nil {
+		password, _ := proxy.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(proxy.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("parent proxy %s refused CONNECT to %s (%s)", proxy.Host, addr, resp.Status)
+	}
+
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// dialSOCKS5 opens a connection to the address through a SOCKS5 proxy
+// (RFC 1928), with username/password authentication if the URL carries a user
+// (RFC 1929). socks5 resolves the host locally and tries its addresses in
+// turn, socks5h leaves it to the proxy.
+func (c *Config) dialSOCKS5(ctx context.Context, proxy *url.URL, addr string) (net.Conn, error) {
+	destinations := []string{addr}
+	if proxy.Scheme == "socks5" {
+		var err error
+		destinations, err = c.lookup(ctx, addr)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var lastErr error
+	for _, destination := range destinations {
+		host, portValue, err := net.SplitHostPort(destination)
+		if err != nil {
+			return nil, err
+		}
+		port, err := strconv.Atoi(portValue)
+		if err != nil {
+			return nil, err
+		}
+		if err := c.checkIP(addr, net.ParseIP(host)); err != nil {
+			lastErr = err
+			continue
+		}
+
+		conn, err := c.dial(ctx, "tcp", proxyAddr(proxy))
+		if err != nil {
+			return nil, err
+		}
+		if err := socks5Connect(ctx, conn, proxy.User, host, port); err != nil {
+			conn.Close()
+			lastErr = fmt.Errorf("parent proxy %s refused connection to %s (%w)", proxy.Host, addr, err)
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+		return conn, nil
+	}
+	return nil, lastErr
+}
+
+// lookup resolves the host of the address for socks5 with the Resolve
+// overrides and the Resolver, it returns the ip:port addresses.
+func (c *Config) lookup(ctx context.Context, addr string) ([]string, error) {
+	if c.Resolve != nil {
+		addr = c.Resolve(addr)
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) != nil {
+		return []string{addr}, nil
+	}
+
+	resolver := c.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	ips, err := resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("host %s has no address", host)
+	}
+	addrs := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		addrs = append(addrs, net.JoinHostPort(ip.IP.String(), port))
+	}
+	return addrs, nil
+}
+
+// socks5Connect runs the handshake within the deadline of the context.
+func socks5Connect(ctx context.Context, conn net.Conn, user *url.Userinfo, host string, port int) error {
+	done := handshakeDeadline(ctx, conn)
+	defer done()
+	return socks5Handshake(conn, user, host, port)
+}
+
+func socks5Handshake(conn net.Conn, user *url.Userinfo, host string, port int) error {
+	method := byte(0x00) // no authentication
+	if user != nil {
+		method = 0x02 // username/password
+	}
+	if _, err := conn.Write([]byte{0x05, 0x01, method}); err != nil {
+		return err
+	}
+
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != 0x05 || reply[1] != method {
+		return errors.New("authentication method is not accepted")
+	}
+
+	if user != nil {
+		password, _ := user.Password()
+		if len(user.Username()) > 255 || len(password) > 255 {
+			return errors.New("credentials are too long")
+		}
+		msg := []byte{0x01, byte(len(user.Username()))}
+		msg = append(msg, user.Username()...)
+		msg = append(msg, byte(len(password)))
+		msg = append(msg, password...)
+		if _, err := conn.Write(msg); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return err
+		}
+		if reply[1] != 0x00 {
+			return errors.New("authentication failed")
+		}
+	}
+
+	msg := []byte{0x05, 0x01, 0x00}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			msg = append(append(msg, 0x01), ip4...)
+		} else {
+			msg = append(append(msg, 0x04), ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return errors.New("host is too long")
+		}
+		msg = append(append(msg, 0x03, byte(len(host))), host...)
+	}
+	msg = append(msg, byte(port>>8), byte(port))
+	if _, err := conn.Write(msg); err != nil {
+		return err
+	}
+
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	if header[1] != 0x00 {
+		return fmt.Errorf("connect failed with reply %d", header[1])
+	}
+
+	// skip the bound address
+	var n int
+	switch header[3] {
+	case 0x01:
+		n = net.IPv4len
+	case 0x04:
+		n = net.IPv6len
+	case 0x03:
+		l := make([]byte, 1)
+		if _, err := io.ReadFull(conn, l); err != nil {
+			return err
+		}
+		n = int(l[0])
+	default:
+		return errors.New("bound address type is unknown")
+	}
+	_, err := io.ReadFull(conn, make([]byte, n+2))
+	return err
+}
+
+// handshakeDeadline applies the deadline of the context to the handshake
+// with the parent proxy, the returned func clears it again.
+func handshakeDeadline(ctx context.Context, conn net.Conn) func() {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	return func() {
+		conn.SetDeadline(time.Time{})
+	}
+}
+
+// bufferedConn returns the bytes read ahead by the handshake first.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
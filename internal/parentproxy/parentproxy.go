@@ -0,0 +1,276 @@
+package parentproxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// Rule sends the traffic to destinations matching Pattern through Proxy, a
+// nil proxy connects directly.
+type Rule struct {
+	Pattern string
+	Proxy   *url.URL
+}
+
+// Rules is a list of rules, it implements flag.Value with pattern=proxy
+// pairs, e.g. "*.corp.example.com=http://proxy.corp:3128" or "*.local=direct".
+type Rules []Rule
+
+func (r *Rules) String() string {
+	pairs := make([]string, 0, len(*r))
+	for _, rule := range *r {
+		proxy := "direct"
+		if rule.Proxy != nil {
+			proxy = rule.Proxy.String()
+		}
+		pairs = append(pairs, rule.Pattern+"="+proxy)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (r *Rules) Set(value string) error {
+	kv := strings.SplitN(value, "=", 2)
+	if len(kv) != 2 {
+		return fmt.Errorf("rule %q is not of the form pattern=proxy", value)
+	}
+
+	pattern := strings.ToLower(strings.TrimSpace(kv[0]))
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("pattern %q is bad (%v)", pattern, err)
+	}
+
+	rule := Rule{Pattern: pattern}
+	if v := strings.TrimSpace(kv[1]); v != "direct" {
+		proxy, err := Parse(v)
+		if err != nil {
+			return err
+		}
+		rule.Proxy = proxy
+	}
+	*r = append(*r, rule)
+	return nil
+}
+
+// Parse parses the URL of a parent proxy, the schemes http, https, socks5
+// and socks5h are supported.
+func Parse(v string) (*url.URL, error) {
+	u, err := url.Parse(v)
+	if err != nil {
+		return nil, fmt.Errorf("parent proxy %q is bad (%v)", v, err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("parent proxy %q has an unsupported scheme", v)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("parent proxy %q has no host", v)
+	}
+	return u, nil
+}
+
+// Config selects the parent proxy of a destination. Destinations matching
+// NoProxy are connected directly, then the first matching rule wins and
+// otherwise the Default proxy is used.
+type Config struct {
+	// Default is the parent proxy of all destinations, nil connects directly.
+	Default *url.URL
+
+	Rules Rules
+
+	// NoProxy is a comma separated list in the format of the NO_PROXY
+	// environment variable: hosts, domains (".example.com"), IPs, CIDRs
+	// with optional ports, or "*".
+	NoProxy string
+
+	// Dial connects to the destinations and parent proxies (or net.Dialer if nil).
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// Resolver resolves the hosts of socks5 proxies (or net.DefaultResolver
+	// if nil) and Resolve overrides their addresses (optional), like Dial
+	// does for the other destinations.
+	Resolver *net.Resolver
+	Resolve  func(addr string) string
+
+	// Check vets the destinations which are handed to parent proxies
+	// (optional), IP addresses as they are and hosts after socks5 resolved
+	// them locally. Hosts resolved by the parent can't be checked.
+	Check func(addr string, ip net.IP) error
+}
+
+// ProxyFor returns the parent proxy of the destination address (host:port),
+// nil if it's connected directly.
+func (c *Config) ProxyFor(addr string) *url.URL {
+	if c == nil {
+		return nil
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	host = strings.ToLower(host)
+
+	if noProxy(c.NoProxy, host, port) {
+		return nil
+	}
+
+	for _, rule := range c.Rules {
+		if ok, _ := path.Match(rule.Pattern, host); ok {
+			return rule.Proxy
+		}
+	}
+	return c.Default
+}
+
+// ProxyFunc returns the proxy selection of http.Transport. SOCKS5 proxies
+// are left out, they're dialed by DialTransport.
+func (c *Config) ProxyFunc() func(req *http.Request) (*url.URL, error) {
+	return func(req *http.Request) (*url.URL, error) {
+		addr := req.URL.Host
+		if req.URL.Port() == "" {
+			port := "80"
+			if req.URL.Scheme == "https" {
+				port = "443"
+			}
+			addr = net.JoinHostPort(req.URL.Hostname(), port)
+		}
+		proxy := c.ProxyFor(addr)
+		if proxy == nil || socks(proxy) {
+			return nil, nil
+		}
+		if err := c.check(addr); err != nil {
+			return nil, err
+		}
+		return proxy, nil
+	}
+}
+
+// DialContext connects to the address through its parent proxy, the
+// connection of an HTTP proxy is tunneled with CONNECT.
+func (c *Config) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	proxy := c.ProxyFor(addr)
+	if proxy == nil {
+		return c.dial(ctx, network, addr)
+	}
+
+	if socks(proxy) {
+		return c.dialSOCKS5(ctx, proxy, addr)
+	}
+	if err := c.check(addr); err != nil {
+		return nil, err
+	}
+	return c.dialConnect(ctx, proxy, addr)
+}
+
+// DialTransport is the dial func of the http.Transport using ProxyFunc, it
+// connects to the destinations of SOCKS5 proxies through them and to
+// everything else, the HTTP proxies included, directly.
+func (c *Config) DialTransport(ctx context.Context, network, addr string) (net.Conn, error) {
+	if proxy := c.ProxyFor(addr); proxy != nil && socks(proxy) && !c.isParent(addr) {
+		return c.dialSOCKS5(ctx, proxy, addr)
+	}
+	return c.dial(ctx, network, addr)
+}
+
+// isParent reports whether the address is the one of a parent proxy.
+func (c *Config) isParent(addr string) bool {
+	if c.Default != nil && proxyAddr(c.Default) == addr {
+		return true
+	}
+	for _, rule := range c.Rules {
+		if rule.Proxy != nil && proxyAddr(rule.Proxy) == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// check vets an IP address destination with Check, hosts are passed.
+func (c *Config) check(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	return c.checkIP(addr, net.ParseIP(host))
+}
+
+func (c *Config) checkIP(addr string, ip net.IP) error {
+	if c.Check == nil || ip == nil {
+		return nil
+	}
+	return c.Check(addr, ip)
+}
+
+func (c *Config) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	if c != nil && c.Dial != nil {
+		return c.Dial(ctx, network, addr)
+	}
+	var d net.Dialer
+	return d.DialContext(ctx, network, addr)
+}
+
+func socks(proxy *url.URL) bool {
+	return proxy.Scheme == "socks5" || proxy.Scheme == "socks5h"
+}
+
+// proxyAddr returns the host:port of the parent proxy.
+func proxyAddr(proxy *url.URL) string {
+	if proxy.Port() != "" {
+		return proxy.Host
+	}
+	switch proxy.Scheme {
+	case "https":
+		return net.JoinHostPort(proxy.Hostname(), "443")
+	case "socks5", "socks5h":
+		return net.JoinHostPort(proxy.Hostname(), "1080")
+	}
+	return net.JoinHostPort(proxy.Hostname(), "80")
+}
+
+func noProxy(list, host, port string) bool {
+	ip := net.ParseIP(host)
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+		if entry == "*" {
+			return true
+		}
+
+		if _, cidr, err := net.ParseCIDR(entry); err == nil {
+			if ip != nil && cidr.Contains(ip) {
+				return true
+			}
+			continue
+		}
+
+		entryHost, entryPort, err := net.SplitHostPort(entry)
+		if err != nil {
+			entryHost, entryPort = entry, ""
+		}
+		if entryPort != "" && entryPort != port {
+			continue
+		}
+
+		if entryIP := net.ParseIP(entryHost); entryIP != nil {
+			if ip != nil && entryIP.Equal(ip) {
+				return true
+			}
+			continue
+		}
+
+		// "example.com" and ".example.com" match the domain and its subdomains
+		domain := strings.TrimPrefix(strings.TrimPrefix(entryHost, "*"), ".")
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
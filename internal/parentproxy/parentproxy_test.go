@@ -0,0 +1,349 @@
+package parentproxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"github.com/donutloop/httpcache/internal/xhttp"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConfig_ProxyFor(t *testing.T) {
+	config := &Config{NoProxy: "localhost, .internal, 10.0.0.0/8, example.org:8080"}
+	{
+		var err error
+		config.Default, err = Parse("http://proxy.corp:3128")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := config.Rules.Set("*.eu.corp=socks5h://socks.eu.corp:1080"); err != nil {
+			t.Fatal(err)
+		}
+		if err := config.Rules.Set("*.local=direct"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := map[string]string{
+		"localhost:80":        "",
+		"api.internal:443":    "",
+		"10.1.2.3:443":        "",
+		"example.org:8080":    "",
+		"example.org:443":     "http://proxy.corp:3128",
+		"printer.local:631":   "",
+		"git.eu.corp:443":     "socks5h://socks.eu.corp:1080",
+		"www.example.com:443": "http://proxy.corp:3128",
+	}
+
+	for addr, want := range tests {
+		var got string
+		if proxy := config.ProxyFor(addr); proxy != nil {
+			got = proxy.String()
+		}
+		if got != want {
+			t.Errorf("proxy of %s is bad, got=%q, want=%q", addr, got, want)
+		}
+	}
+}
+
+func TestConfig_DialContext(t *testing.T) {
+	upstream := echoServer(t)
+	defer upstream.Close()
+
+	var connectTo string
+	proxyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		connectTo = r.Host
+		conn, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		clientConn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		clientConn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		go io.Copy(conn, clientConn)
+		io.Copy(clientConn, conn)
+	}))
+	defer proxyServer.Close()
+
+	socksServer := socks5Server(t)
+	defer socksServer.Close()
+
+	for _, proxy := range []string{proxyServer.URL, "socks5://" + socksServer.Addr().String()} {
+		u, err := url.Parse(proxy)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		config := &Config{Default: u}
+		conn, err := config.DialContext(context.Background(), "tcp", upstream.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := conn.Write([]byte("ping\n")); err != nil {
+			t.Fatal(err)
+		}
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+
+		if line != "ping\n" {
+			t.Fatalf("echo through %s is bad, got=%q", proxy, line)
+		}
+	}
+
+	if connectTo != upstream.Addr().String() {
+		t.Fatalf("CONNECT destination is bad, got=%s", connectTo)
+	}
+}
+
+func TestConfig_DialContextTimeout(t *testing.T) {
+	// the parent proxy accepts connections but never answers the handshake
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	u, err := url.Parse("socks5://" + l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	config := &Config{Default: u}
+	_, err = config.DialContext(ctx, "tcp", "127.0.0.1:80")
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatalf("error is bad, got=%v", err)
+	}
+}
+
+func TestConfig_Check(t *testing.T) {
+	var connects []string
+	proxyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		connects = append(connects, r.Host)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer proxyServer.Close()
+
+	socksServer := socks5Server(t)
+	defer socksServer.Close()
+
+	blocked := errors.New("blocked")
+	check := func(addr string, ip net.IP) error {
+		if ip.IsLoopback() || ip.IsLinkLocalUnicast() {
+			return blocked
+		}
+		return nil
+	}
+
+	for _, proxy := range []string{proxyServer.URL, "socks5://" + socksServer.Addr().String(), "socks5h://" + socksServer.Addr().String()} {
+		u, err := url.Parse(proxy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config := &Config{Default: u, Check: check}
+
+		for _, addr := range []string{"169.254.169.254:80", "127.0.0.1:6379"} {
+			if _, err := config.DialContext(context.Background(), "tcp", addr); !errors.Is(err, blocked) {
+				t.Errorf("error of %s through %s is bad (%v)", addr, proxy, err)
+			}
+		}
+
+		// socks5 resolves the host locally, socks5h leaves it to the parent
+		_, err = config.DialContext(context.Background(), "tcp", "localhost:6379")
+		if errors.Is(err, blocked) != (u.Scheme == "socks5") {
+			t.Errorf("error of localhost through %s is bad (%v)", proxy, err)
+		}
+	}
+
+	u, err := url.Parse(proxyServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &Config{Default: u, Check: check}
+	req, err := http.NewRequest(http.MethodGet, "http://169.254.169.254/latest/meta-data/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := config.ProxyFunc()(req); !errors.Is(err, blocked) {
+		t.Fatalf("error of proxy func is bad (%v)", err)
+	}
+
+	// only the host, which the parent resolves, reached it
+	if len(connects) != 1 || connects[0] != "localhost:6379" {
+		t.Fatalf("destinations of the parent proxy are bad, got=%v", connects)
+	}
+}
+
+func TestConfig_DialTransport(t *testing.T) {
+	upstream := echoServer(t)
+	defer upstream.Close()
+
+	socksServer := socks5Server(t)
+	defer socksServer.Close()
+
+	u, err := url.Parse("socks5://" + socksServer.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &Config{Default: u}
+
+	// the transport leaves SOCKS5 proxies to its dial func
+	req, err := http.NewRequest(http.MethodGet, "http://"+upstream.Addr().String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if proxy, err := config.ProxyFunc()(req); proxy != nil || err != nil {
+		t.Fatalf("proxy is bad, got=%v (%v)", proxy, err)
+	}
+
+	conn, err := config.DialTransport(context.Background(), "tcp", upstream.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("ping\n")); err != nil {
+		t.Fatal(err)
+	}
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "ping\n" {
+		t.Fatalf("echo is bad, got=%q", line)
+	}
+}
+
+func TestConfig_DialContextResolve(t *testing.T) {
+	upstream := echoServer(t)
+	defer upstream.Close()
+
+	socksServer := socks5Server(t)
+	defer socksServer.Close()
+
+	u, err := url.Parse("socks5://" + socksServer.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the test server resolves IPv4 addresses only, so the host is overridden
+	resolve := xhttp.Resolve{}
+	if err := resolve.Set("origin.test=" + upstream.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	lookupErr := errors.New("dns server is down")
+	config := &Config{
+		Default: u,
+		Resolve: resolve.Address,
+		Resolver: &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				return nil, lookupErr
+			},
+		},
+	}
+
+	conn, err := config.DialContext(context.Background(), "tcp", "origin.test:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write([]byte("ping\n")); err != nil {
+		t.Fatal(err)
+	}
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if line != "ping\n" {
+		t.Fatalf("echo is bad, got=%q", line)
+	}
+
+	// other hosts are resolved with the resolver of the config
+	if _, err := config.DialContext(context.Background(), "tcp", "other.test:80"); err == nil || !strings.Contains(err.Error(), lookupErr.Error()) {
+		t.Fatalf("error is bad (%v)", err)
+	}
+}
+
+func echoServer(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(conn, conn)
+		}
+	}()
+	return l
+}
+
+// socks5Server accepts unauthenticated CONNECT requests to IPv4 addresses.
+func socks5Server(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				greeting := make([]byte, 3)
+				if _, err := io.ReadFull(conn, greeting); err != nil {
+					return
+				}
+				conn.Write([]byte{0x05, 0x00})
+
+				request := make([]byte, 10)
+				if _, err := io.ReadFull(conn, request); err != nil || request[3] != 0x01 {
+					return
+				}
+				addr := &net.TCPAddr{IP: net.IP(request[4:8]), Port: int(request[8])<<8 | int(request[9])}
+				upstream, err := net.Dial("tcp", addr.String())
+				if err != nil {
+					conn.Write([]byte{0x05, 0x05, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+					return
+				}
+				defer upstream.Close()
+				conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+				go io.Copy(upstream, conn)
+				io.Copy(conn, upstream)
+			}()
+		}
+	}()
+	return l
+}
@@ -0,0 +1,196 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"github.com/donutloop/httpcache/internal/auth"
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Error is returned for requests over the limit.
+type Error struct {
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("rate limit is exceeded, retry after %s", e.RetryAfter)
+}
+
+// RetryAfterSeconds returns the value of the Retry-After header.
+func (e *Error) RetryAfterSeconds() string {
+	return fmt.Sprint(int64(math.Ceil(e.RetryAfter.Seconds())))
+}
+
+// Limiter is a token bucket per client, each bucket holds up to Burst tokens
+// and is refilled with Rate tokens per second.
+type Limiter struct {
+	rate  float64
+	burst float64
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewLimiter creates a limiter of rate requests per second, burst defaults
+// to the rate.
+func NewLimiter(rate float64, burst int) *Limiter {
+	if burst <= 0 {
+		burst = int(math.Ceil(rate))
+	}
+	return &Limiter{
+		rate:      rate,
+		burst:     float64(burst),
+		buckets:   make(map[string]*bucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// Allow takes a token from the bucket of the key, otherwise it returns the
+// time until the next token is available.
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sweep(now)
+
+	b := l.refill(key, now)
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+// Available reports whether the bucket of the key holds a token without
+// taking it, otherwise it returns the time until the next token is available.
+func (l *Limiter) Available(key string) (bool, time.Duration) {
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sweep(now)
+
+	b := l.refill(key, now)
+	if b.tokens >= 1 {
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+// refill returns the bucket of the key with the tokens added since it was
+// last used.
+func (l *Limiter) refill(key string, now time.Time) *bucket {
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	return b
+}
+
+// sweep drops the buckets which are full again once a minute, so that the
+// map doesn't grow with every client ever seen.
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	full := time.Duration(l.burst / l.rate * float64(time.Second))
+	for key, b := range l.buckets {
+		if now.Sub(b.last) >= full {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// Concurrency limits the in-flight requests per client.
+type Concurrency struct {
+	max int
+
+	mu     sync.Mutex
+	active map[string]int
+}
+
+func NewConcurrency(max int) *Concurrency {
+	return &Concurrency{max: max, active: make(map[string]int)}
+}
+
+// Acquire reserves a slot of the key, it has to be released once the
+// request is done.
+func (c *Concurrency) Acquire(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.active[key] >= c.max {
+		return false
+	}
+	c.active[key]++
+	return true
+}
+
+func (c *Concurrency) Release(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.active[key] <= 1 {
+		delete(c.active, key)
+		return
+	}
+	c.active[key]--
+}
+
+// Key returns the client of the request, the authenticated user or else the
+// IP address.
+func Key(req *http.Request) string {
+	if identity := auth.Identity(req.Context()); identity != "" {
+		return "user:" + identity
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+type keyKey struct{}
+
+// WithKey returns a copy of the context which carries the client key.
+func WithKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, keyKey{}, key)
+}
+
+// KeyOf returns the client key which the context carries.
+func KeyOf(ctx context.Context) (string, bool) {
+	key, ok := ctx.Value(keyKey{}).(string)
+	return key, ok
+}
+
+// Transport limits the requests which reach the underlying transport, e.g.
+// the cache misses, per client. Requests without client key pass.
+type Transport struct {
+	Transport http.RoundTripper
+	Limiter   *Limiter
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if key, ok := KeyOf(req.Context()); ok {
+		if allowed, retryAfter := t.Limiter.Allow(key); !allowed {
+			return nil, &Error{RetryAfter: retryAfter}
+		}
+	}
+	return t.Transport.RoundTrip(req)
+}
@@ -0,0 +1,85 @@
+package ratelimit
+
+import (
+	"errors"
+	"github.com/donutloop/httpcache/internal/auth"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLimiter_Allow(t *testing.T) {
+	limiter := NewLimiter(10, 2)
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := limiter.Allow("a"); !ok {
+			t.Fatalf("request %d is limited", i)
+		}
+	}
+
+	ok, retryAfter := limiter.Allow("a")
+	if ok || retryAfter <= 0 || retryAfter > 100*time.Millisecond {
+		t.Fatalf("limit is bad, got=(%v, %v)", ok, retryAfter)
+	}
+
+	if ok, _ := limiter.Allow("b"); !ok {
+		t.Fatal("other key is limited")
+	}
+
+	time.Sleep(retryAfter)
+	if ok, _ := limiter.Allow("a"); !ok {
+		t.Fatal("bucket is not refilled")
+	}
+}
+
+func TestKey(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	if key := Key(req); key != "192.0.2.1" {
+		t.Fatalf("key is bad, got=%s", key)
+	}
+
+	req = req.WithContext(auth.WithIdentity(req.Context(), "alice"))
+	if key := Key(req); key != "user:alice" {
+		t.Fatalf("key is bad, got=%s", key)
+	}
+}
+
+func TestTransport(t *testing.T) {
+	var upstream int
+	transport := &Transport{
+		Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			upstream++
+			return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+		}),
+		Limiter: NewLimiter(1, 1),
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req = req.WithContext(WithKey(req.Context(), "a"))
+
+	if _, err := transport.RoundTrip(req); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := transport.RoundTrip(req)
+	var limitErr *Error
+	if !errors.As(err, &limitErr) || limitErr.RetryAfterSeconds() != "1" {
+		t.Fatalf("error is bad (%v)", err)
+	}
+
+	// requests without client pass
+	if _, err := transport.RoundTrip(httptest.NewRequest(http.MethodGet, "http://example.com/", nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	if upstream != 2 {
+		t.Fatalf("upstream requests are bad, got=%d", upstream)
+	}
+}
+
+type roundTripFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
@@ -0,0 +1,236 @@
+package roundtripper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var CircuitIsOpen = errors.New("circuit of origin is open")
+
+var OriginIsBusy = errors.New("origin is busy")
+
+// BreakerTransport protects the origins from the proxy. It limits the
+// in-flight requests per host, further requests wait in a queue, and it opens
+// the circuit of a host after consecutive failures, so that requests fail
+// fast with CircuitIsOpen. After OpenTimeout a single request probes the
+// origin, its success closes the circuit again.
+type BreakerTransport struct {
+	Transport http.RoundTripper // underlying transport (or default if nil)
+
+	// MaxInFlight limits the requests per host until their response body is
+	// closed, zero means no limit. QueueTimeout limits the wait for a free
+	// slot, zero fails at once.
+	MaxInFlight  int
+	QueueTimeout time.Duration
+
+	// Failures is the number of consecutive errors and 502, 503 and 504
+	// responses which open the circuit, zero disables the breaker.
+	Failures    int
+	OpenTimeout time.Duration
+
+	mu        sync.Mutex
+	origins   map[string]*origin
+	lastSweep time.Time
+}
+
+func (t *BreakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	o := t.origin(req.URL.Host)
+
+	if !o.allow(time.Now()) {
+		return nil, fmt.Errorf("%w: %s", CircuitIsOpen, req.URL.Host)
+	}
+
+	if err := o.acquire(req.Context(), t.QueueTimeout); err != nil {
+		o.abort()
+		if errors.Is(err, OriginIsBusy) {
+			return nil, fmt.Errorf("%w: %s", OriginIsBusy, req.URL.Host)
+		}
+		return nil, err
+	}
+
+	resp, err := t.transport().RoundTrip(req)
+	if err != nil {
+		o.release()
+		if errors.Is(err, context.Canceled) {
+			// the client went away, that says nothing about the origin
+			o.abort()
+			return nil, err
+		}
+		o.record(true, time.Now())
+		return nil, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		o.record(true, time.Now())
+	default:
+		o.record(false, time.Now())
+	}
+
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		// an upgraded connection isn't a request in flight anymore
+		o.release()
+		return resp, nil
+	}
+	resp.Body = &releaseBody{ReadCloser: resp.Body, release: o.release}
+	return resp, nil
+}
+
+func (t *BreakerTransport) transport() http.RoundTripper {
+	if t.Transport == nil {
+		return http.DefaultTransport
+	}
+	return t.Transport
+}
+
+func (t *BreakerTransport) origin(host string) *origin {
+	now := time.Now()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.origins == nil {
+		t.origins = make(map[string]*origin)
+		t.lastSweep = now
+	}
+	t.sweep(now)
+
+	o, ok := t.origins[host]
+	if !ok {
+		o = &origin{failures: t.Failures, openTimeout: t.OpenTimeout}
+		if t.MaxInFlight > 0 {
+			o.slots = make(chan struct{}, t.MaxInFlight)
+		}
+		t.origins[host] = o
+	}
+	o.last = now
+	return o
+}
+
+// sweep drops the origins which weren't requested for a minute, have no
+// request in flight and a closed circuit without failures, so that the map
+// doesn't grow with every host ever seen.
+func (t *BreakerTransport) sweep(now time.Time) {
+	if now.Sub(t.lastSweep) < time.Minute {
+		return
+	}
+	t.lastSweep = now
+	for host, o := range t.origins {
+		if now.Sub(o.last) >= time.Minute && o.idle() {
+			delete(t.origins, host)
+		}
+	}
+}
+
+// origin is the state of a host, slots is nil without limit. last is guarded
+// by the mutex of the transport.
+type origin struct {
+	slots       chan struct{}
+	failures    int
+	openTimeout time.Duration
+	last        time.Time
+
+	mu        sync.Mutex
+	failed    int
+	openUntil time.Time
+	probing   bool
+}
+
+// allow reports whether the circuit lets the request pass, once it's open
+// only a single probe passes after the timeout.
+func (o *origin) allow(now time.Time) bool {
+	if o.failures <= 0 {
+		return true
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.failed < o.failures {
+		return true
+	}
+	if now.Before(o.openUntil) || o.probing {
+		return false
+	}
+	o.probing = true
+	return true
+}
+
+// idle reports whether the origin has no request in flight and no failures.
+func (o *origin) idle() bool {
+	if len(o.slots) > 0 {
+		return false
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.failed == 0 && !o.probing
+}
+
+// abort gives up the probe of a request which didn't reach the origin.
+func (o *origin) abort() {
+	o.mu.Lock()
+	o.probing = false
+	o.mu.Unlock()
+}
+
+func (o *origin) record(failed bool, now time.Time) {
+	if o.failures <= 0 {
+		return
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.probing = false
+	if !failed {
+		o.failed = 0
+		return
+	}
+	o.failed++
+	if o.failed >= o.failures {
+		o.openUntil = now.Add(o.openTimeout)
+	}
+}
+
+func (o *origin) acquire(ctx context.Context, timeout time.Duration) error {
+	if o.slots == nil {
+		return nil
+	}
+	select {
+	case o.slots <- struct{}{}:
+		return nil
+	default:
+	}
+	if timeout <= 0 {
+		return OriginIsBusy
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case o.slots <- struct{}{}:
+		return nil
+	case <-timer.C:
+		return OriginIsBusy
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (o *origin) release() {
+	if o.slots != nil {
+		<-o.slots
+	}
+}
+
+// releaseBody frees the slot of the request once the body is closed.
+type releaseBody struct {
+	io.ReadCloser
+	release func()
+	once    sync.Once
+}
+
+func (b *releaseBody) Close() error {
+	b.once.Do(b.release)
+	return b.ReadCloser.Close()
+}
@@ -0,0 +1,238 @@
+package roundtripper
+
+import (
+	"errors"
+	"github.com/donutloop/httpcache/internal/cache"
+	"github.com/donutloop/httpcache/internal/size"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBreakerTransport_Circuit(t *testing.T) {
+	var calls int
+	failing := true
+	transport := &BreakerTransport{
+		Failures:    2,
+		OpenTimeout: 50 * time.Millisecond,
+		Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			calls++
+			code := http.StatusOK
+			if failing {
+				code = http.StatusBadGateway
+			}
+			return &http.Response{StatusCode: code, Body: http.NoBody}, nil
+		}),
+	}
+
+	get := func() error {
+		req, _ := http.NewRequest(http.MethodGet, "http://origin.test/", nil)
+		resp, err := transport.RoundTrip(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := get(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := get(); !errors.Is(err, CircuitIsOpen) {
+		t.Fatalf("error is bad (%v)", err)
+	}
+	if calls != 2 {
+		t.Fatalf("calls are bad, got=%d", calls)
+	}
+
+	// other origins are not affected
+	req, _ := http.NewRequest(http.MethodGet, "http://other.test/", nil)
+	if _, err := transport.RoundTrip(req); err != nil {
+		t.Fatal(err)
+	}
+
+	// the failed probe opens the circuit again
+	time.Sleep(60 * time.Millisecond)
+	if err := get(); err != nil {
+		t.Fatal(err)
+	}
+	if err := get(); !errors.Is(err, CircuitIsOpen) {
+		t.Fatalf("error is bad (%v)", err)
+	}
+
+	// the successful probe closes it
+	failing = false
+	time.Sleep(60 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		if err := get(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestBreakerTransport_MaxInFlight(t *testing.T) {
+	transport := &BreakerTransport{
+		MaxInFlight:  1,
+		QueueTimeout: 20 * time.Millisecond,
+		Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader("body"))}, nil
+		}),
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, "http://origin.test/", nil)
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := transport.RoundTrip(req); !errors.Is(err, OriginIsBusy) {
+		t.Fatalf("error is bad (%v)", err)
+	}
+
+	// the queued request gets the slot once the body is closed
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		resp.Body.Close()
+	}()
+	resp, err = transport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+}
+
+func TestBreakerTransport_Sweep(t *testing.T) {
+	transport := &BreakerTransport{
+		MaxInFlight: 1,
+		Failures:    2,
+		Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			code := http.StatusOK
+			if req.URL.Host == "failing.test" {
+				code = http.StatusBadGateway
+			}
+			return &http.Response{StatusCode: code, Body: http.NoBody}, nil
+		}),
+	}
+
+	var inFlight *http.Response
+	for _, host := range []string{"idle.test", "busy.test", "failing.test"} {
+		req, _ := http.NewRequest(http.MethodGet, "http://"+host+"/", nil)
+		resp, err := transport.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if host == "busy.test" {
+			inFlight = resp
+			continue
+		}
+		resp.Body.Close()
+	}
+	defer inFlight.Body.Close()
+
+	transport.mu.Lock()
+	transport.sweep(time.Now().Add(2 * time.Minute))
+	_, idle := transport.origins["idle.test"]
+	_, busy := transport.origins["busy.test"]
+	_, failing := transport.origins["failing.test"]
+	transport.mu.Unlock()
+
+	if idle || !busy || !failing {
+		t.Fatalf("swept origins are bad, got=(idle %v, busy %v, failing %v)", idle, busy, failing)
+	}
+}
+
+func TestBreakerTransport_DefaultTransport(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer origin.Close()
+
+	transport := &BreakerTransport{Failures: 1}
+	req, _ := http.NewRequest(http.MethodGet, origin.URL, nil)
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status code is bad (%v)", resp.StatusCode)
+	}
+}
+
+func TestCacheTransport_ServeStale(t *testing.T) {
+	var calls int
+	c := cache.NewLRUCache(1*size.MB, 0)
+	transport := &CacheTransport{
+		Cache:      c,
+		StatusTTL:  StatusTTL{"200": 10 * time.Millisecond},
+		ServeStale: true,
+		Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			calls++
+			if calls > 1 {
+				return nil, CircuitIsOpen
+			}
+			return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: ioutil.NopCloser(strings.NewReader("stale"))}, nil
+		}),
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, "http://origin.test/", nil)
+	if _, err := transport.RoundTrip(req); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	if string(body) != "stale" || calls != 2 {
+		t.Fatalf("response is bad, got=(%s, %d)", body, calls)
+	}
+
+	transport.ServeStale = false
+	if _, err := transport.RoundTrip(req); !errors.Is(err, CircuitIsOpen) {
+		t.Fatalf("error is bad (%v)", err)
+	}
+}
+
+func TestBreakerTransport_ResponseIsToLarge(t *testing.T) {
+	var closed int
+	transport := &ResponseBodyLimitRoundTripper{
+		Limit: 2,
+		Transport: &BreakerTransport{
+			MaxInFlight: 1,
+			Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				body := &closeCounter{ReadCloser: ioutil.NopCloser(strings.NewReader("large")), closed: &closed}
+				return &http.Response{StatusCode: http.StatusOK, ContentLength: 5, Body: body}, nil
+			}),
+		},
+	}
+
+	// the slot of the oversized response is released for the next request
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest(http.MethodGet, "http://origin.test/", nil)
+		if _, err := transport.RoundTrip(req); err != ResponseIsToLarge {
+			t.Fatalf("error is bad (%v)", err)
+		}
+	}
+	if closed != 2 {
+		t.Fatalf("closed bodies are bad, got=%d", closed)
+	}
+}
+
+type closeCounter struct {
+	io.ReadCloser
+	closed *int
+}
+
+func (c *closeCounter) Close() error {
+	*c.closed++
+	return c.ReadCloser.Close()
+}
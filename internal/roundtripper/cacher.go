@@ -3,52 +3,319 @@ package roundtripper
 import (
 	"crypto/md5"
 	"encoding/hex"
+	"errors"
 	"github.com/donutloop/httpcache/internal/cache"
+	"io/ioutil"
 	"net/http"
 	"net/http/httputil"
+	"net/url"
+	"time"
 )
 
 type CacheTransport struct {
 	Cache     *cache.LRUCache
 	Transport http.RoundTripper // underlying transport (or default if nil)
+
+	// StatusTTL limits how long responses are cached by their status code,
+	// responses with unlisted status codes are cached until they get evicted.
+	StatusTTL StatusTTL
+
+	// CachePOST makes POST responses cacheable, they are keyed by the request body.
+	CachePOST bool
+
+	// FetchFullOnRange fetches the complete object on a range request which
+	// misses the cache, otherwise the range request is passed through uncached.
+	FetchFullOnRange bool
+
+	// SliceSize enables the caching of objects larger than SliceSize in
+	// independently fetched slices of SliceSize bytes, zero disables it.
+	SliceSize int64
+
+	// Compress stores uncompressed bodies gzipped, so that they count with
+	// their compressed size against the capacity of the cache.
+	Compress bool
+
+	// ServeStale keeps stale responses, they answer the requests to origins
+	// whose circuit is open (see BreakerTransport).
+	ServeStale bool
 }
 
 func (t *CacheTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if cachePolicy(req).NoCache {
+		return t.Transport.RoundTrip(req)
+	}
+
+	if !t.cacheable(req) {
+		return t.forward(req)
+	}
+
 	clonedRequest, err := makeHashFromRequest(req)
 	if err != nil {
 		return nil, err
 	}
-	cachedResponse, ok := t.Cache.Get(clonedRequest)
+
+	if req.Method == http.MethodHead {
+		// a cached GET response answers the HEAD request as well
+		getRequest := new(http.Request)
+		*getRequest = *req
+		getRequest.Method = http.MethodGet
+		getKey, err := makeHashFromRequest(getRequest)
+		if err != nil {
+			return nil, err
+		}
+		if cachedResponse, ok := t.get(getKey); ok {
+			return t.respond(req, cachedResponse)
+		}
+		if meta, ok := t.get(sliceMetaKey(getKey)); ok {
+			return t.slicedResponse(req, getKey, meta), nil
+		}
+	}
+
+	if cachedResponse, ok := t.get(clonedRequest); ok {
+		return t.respond(req, cachedResponse)
+	}
+
+	if req.Method == http.MethodGet && t.SliceSize > 0 {
+		return t.roundTripSliced(req, clonedRequest)
+	}
+
+	upstreamRequest := req
+	if req.Header.Get("Range") != "" {
+		if !t.FetchFullOnRange {
+			return t.forward(req)
+		}
+		// fetch the full object, so that later ranges hit the cache
+		upstreamRequest = withoutRange(req)
+	}
+
+	proxyResponse, err := t.forward(upstreamRequest)
+	if err != nil {
+		if staleResponse, ok := t.stale(clonedRequest, err); ok {
+			return t.respond(req, staleResponse)
+		}
+		return nil, err
+	}
+
+	cachedResponse, err := t.store(clonedRequest, upstreamRequest, proxyResponse)
+	if err != nil {
+		return nil, err
+	}
+	if cachedResponse == nil {
+		return proxyResponse, nil
+	}
+	return t.respond(req, cachedResponse)
+}
+
+// forward sends the request upstream. Successful responses to unsafe
+// methods invalidate the cached responses, cacheable POSTs included.
+func (t *CacheTransport) forward(req *http.Request) (*http.Response, error) {
+	proxyResponse, err := t.Transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if !isSafe(req.Method) && proxyResponse.StatusCode >= 200 && proxyResponse.StatusCode < 400 {
+		t.invalidate(req, proxyResponse)
+	}
+	return proxyResponse, nil
+}
+
+// store caches the upstream response under the key. It returns nil if the
+// response isn't cacheable, in that case its body is left untouched.
+func (t *CacheTransport) store(key string, req *http.Request, proxyResponse *http.Response) (*cache.CachedResponse, error) {
+	expires, ok := t.expires(req, proxyResponse)
 	if !ok {
-		proxyResponse, err := t.Transport.RoundTrip(req)
+		return nil, nil
+	}
+	cachedResponse := &cache.CachedResponse{URL: cacheURL(req.URL), Method: req.Method, Expires: expires}
+
+	if req.Method != http.MethodHead {
+		body, err := ioutil.ReadAll(proxyResponse.Body)
+		proxyResponse.Body.Close()
 		if err != nil {
 			return nil, err
 		}
-		cachedResponse = &cache.CachedResponse{Resp: proxyResponse}
-		t.Cache.Set(clonedRequest, cachedResponse)
-		return cachedResponse.Resp, nil
+		cachedResponse.Body = body
 	}
-	return cachedResponse.Resp, nil
+	cachedResponse.Resp = storedResponse(proxyResponse)
+
+	if t.Compress {
+		if err := compress(cachedResponse); err != nil {
+			return nil, err
+		}
+	}
+
+	t.Cache.Set(key, cachedResponse)
+	return cachedResponse, nil
 }
 
-// CloneRequest returns a clone of the provided *http.Request. The clone is a
-// shallow copy of the struct and its Header map.
-func makeHashFromRequest(r *http.Request) (string, error) {
-	// shallow copy of the struct
-	r2 := new(http.Request)
-	*r2 = *r
-	// deep copy of the Header
-	r2.Header = make(http.Header)
-	for k, s := range r.Header {
-		r2.Header[k] = s
+// expires returns when the upstream response goes stale according to the
+// status ttl table, and false if it isn't cacheable at all.
+func (t *CacheTransport) expires(req *http.Request, proxyResponse *http.Response) (time.Time, bool) {
+	statusTTL := t.StatusTTL
+	if policy := cachePolicy(req); policy.StatusTTL != nil {
+		statusTTL = policy.StatusTTL
+	}
+
+	ttl, ok := statusTTL.Lookup(proxyResponse.StatusCode)
+	if !ok {
+		return time.Time{}, true
+	}
+
+	now := time.Now()
+	if ttl == FromHeaders {
+		ttl = freshness(proxyResponse.Header, now)
+	}
+	if ttl <= 0 {
+		return time.Time{}, false
+	}
+	return now.Add(ttl), true
+}
+
+// storedResponse returns a copy of the response which doesn't hold on to the
+// connection or the request.
+func storedResponse(proxyResponse *http.Response) *http.Response {
+	resp := new(http.Response)
+	*resp = *proxyResponse
+	resp.Body = http.NoBody
+	resp.Request = nil
+	resp.Header = proxyResponse.Header.Clone()
+	RemoveHopHeaders(resp.Header)
+	return resp
+}
+
+// respond answers the request from the cached response. Compressed bodies
+// are decompressed for clients which don't accept them and for ranges.
+func (t *CacheTransport) respond(req *http.Request, cachedResponse *cache.CachedResponse) (*http.Response, error) {
+	if cachedResponse.Encoding != "" {
+		if acceptsEncoding(req, cachedResponse.Encoding) && req.Header.Get("Range") == "" {
+			return encodedResponse(req, cachedResponse), nil
+		}
+		decoded, err := decode(cachedResponse)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := t.respond(req, decoded)
+		if err != nil {
+			return nil, err
+		}
+		// both forms are served for the same url
+		varyAcceptEncoding(resp.Header)
+		return resp, nil
+	}
+
+	if req.Method == http.MethodGet && req.Header.Get("Range") != "" {
+		return rangeResponse(req, cachedResponse), nil
 	}
+	return cachedResponse.Response(req), nil
+}
 
-	d, err := httputil.DumpRequest(r, true)
+// get returns the cached response of the key, expired responses are removed
+// unless they're kept to be served stale.
+func (t *CacheTransport) get(key string) (*cache.CachedResponse, bool) {
+	cachedResponse, ok := t.Cache.Get(key)
+	if ok && cachedResponse.Expired(time.Now()) {
+		if !t.ServeStale {
+			t.Cache.Delete(key)
+		}
+		return nil, false
+	}
+	return cachedResponse, ok
+}
+
+// stale returns the stale response of the key if the upstream failed because
+// the circuit of the origin is open.
+func (t *CacheTransport) stale(key string, err error) (*cache.CachedResponse, bool) {
+	if !t.ServeStale || !errors.Is(err, CircuitIsOpen) {
+		return nil, false
+	}
+	return t.Cache.Get(key)
+}
+
+func (t *CacheTransport) cacheable(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		return true
+	case http.MethodPost:
+		return t.CachePOST
+	}
+	return false
+}
+
+// invalidate removes the cached responses of the request URL and of the
+// Location and Content-Location URLs of the response (RFC 9111 section 4.4).
+// Location URLs of other hosts are ignored, they could be used to evict
+// arbitrary entries.
+func (t *CacheTransport) invalidate(req *http.Request, resp *http.Response) {
+	urls := map[string]bool{cacheURL(req.URL): true}
+	for _, name := range []string{"Location", "Content-Location"} {
+		v := resp.Header.Get(name)
+		if v == "" {
+			continue
+		}
+		u, err := req.URL.Parse(v)
+		if err != nil || u.Host != req.URL.Host {
+			continue
+		}
+		urls[cacheURL(u)] = true
+	}
+
+	t.Cache.DeleteFunc(func(key string, value *cache.CachedResponse) bool {
+		return urls[value.URL]
+	})
+}
+
+// isSafe reports whether the method is safe (RFC 9110 section 9.2.1).
+func isSafe(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+// cacheURL returns the URL under which a response is cached, without fragment.
+func cacheURL(u *url.URL) string {
+	u2 := *u
+	u2.Fragment = ""
+	return u2.String()
+}
+
+// makeHashFromRequest returns the cache key of the request, the scheme and
+// host of the URL included. Range headers are left out, ranges are served
+// from the cached full object.
+func makeHashFromRequest(r *http.Request) (string, error) {
+	r2 := withoutRange(r)
+	// HTTP/1 and HTTP/2 clients share the entries, regardless of the proxies
+	// they came through
+	r2.Proto, r2.ProtoMajor, r2.ProtoMinor = "HTTP/1.1", 1, 1
+	r2.Header.Del("Via")
+	r2.Header.Del("X-Forwarded-For")
+	d, err := httputil.DumpRequest(r2, true)
 	if err != nil {
 		return "", err
 	}
+	// the body was drained by the dump, hand its replacement back
+	r.Body = r2.Body
 
+	// the dump carries the Host header only, the destination is keyed as well
 	hasher := md5.New()
+	hasher.Write([]byte(r.URL.Scheme + "://" + r.URL.Host + "\n"))
 	hasher.Write([]byte(d))
 	return hex.EncodeToString(hasher.Sum(nil)), nil
 }
+
+// withoutRange returns a shallow copy of the request without the Range and
+// If-Range headers.
+func withoutRange(r *http.Request) *http.Request {
+	// shallow copy of the struct
+	r2 := new(http.Request)
+	*r2 = *r
+	// deep copy of the Header
+	r2.Header = make(http.Header)
+	for k, s := range r.Header {
+		r2.Header[k] = s
+	}
+	r2.Header.Del("Range")
+	r2.Header.Del("If-Range")
+	return r2
+}
@@ -1,8 +1,14 @@
 package roundtripper
 
 import (
+	"github.com/donutloop/httpcache/internal/cache"
+	"github.com/donutloop/httpcache/internal/size"
+	"io/ioutil"
 	"net/http"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestMakeHashFromRequest(t *testing.T) {
@@ -31,3 +37,221 @@ func TestMakeHashFromRequest(t *testing.T) {
 	t.Log("hash 1: " + hash1)
 	t.Log("hash 2: " + hash1)
 }
+
+func TestMakeHashFromRequest_HTTP2(t *testing.T) {
+	req, err := http.NewRequest(http.MethodGet, "http://test.de", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hash1, err := makeHashFromRequest(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Proto, req.ProtoMajor, req.ProtoMinor = "HTTP/2.0", 2, 0
+	hash2, err := makeHashFromRequest(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if hash1 != hash2 {
+		t.Fatalf("hash of http/2 request is bad, got=%s, want=%s", hash2, hash1)
+	}
+}
+
+func TestMakeHashFromRequest_Destination(t *testing.T) {
+	hash := func(rawURL, host string) string {
+		req, err := http.NewRequest(http.MethodGet, rawURL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Host = host
+		h, err := makeHashFromRequest(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+
+	victim := hash("https://victim.test/a", "victim.test")
+	if spoofed := hash("https://attacker.test/a", "victim.test"); spoofed == victim {
+		t.Fatal("hash of spoofed host header is the one of the victim")
+	}
+	if plain := hash("http://victim.test/a", "victim.test"); plain == victim {
+		t.Fatal("hash of http is the one of https")
+	}
+}
+
+type roundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestCacheTransport_StatusTTL(t *testing.T) {
+	var calls int
+	c := cache.NewLRUCache(1*size.MB, 0)
+	transport := &CacheTransport{
+		Cache:     c,
+		StatusTTL: StatusTTL{"5xx": 0, "404": time.Minute},
+		Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			calls++
+			code := http.StatusNotFound
+			if req.URL.Path == "/broken" {
+				code = http.StatusBadGateway
+			}
+			return &http.Response{StatusCode: code, Header: make(http.Header), Body: http.NoBody, Request: req}, nil
+		}),
+	}
+
+	for _, path := range []string{"/missing", "/missing", "/broken", "/broken"} {
+		req, err := http.NewRequest(http.MethodGet, "http://test.de"+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := transport.RoundTrip(req); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if calls != 3 {
+		t.Fatalf("upstream calls are bad, got=%d", calls)
+	}
+
+	if c.Length() != 1 {
+		t.Fatalf("cache length is bad, got=%d", c.Length())
+	}
+}
+
+func TestCacheTransport_UnsafeMethods(t *testing.T) {
+	var calls int
+	c := cache.NewLRUCache(1*size.MB, 0)
+	transport := &CacheTransport{
+		Cache: c,
+		Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			calls++
+			resp := &http.Response{StatusCode: http.StatusOK, Header: make(http.Header), Body: http.NoBody, Request: req}
+			if req.Method == http.MethodPost {
+				resp.StatusCode = http.StatusCreated
+				resp.Header.Set("Location", "/items/1")
+			}
+			return resp, nil
+		}),
+	}
+
+	do := func(method, url string) {
+		req, err := http.NewRequest(method, url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := transport.RoundTrip(req); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	do(http.MethodGet, "http://test.de/items")
+	do(http.MethodGet, "http://test.de/items/1")
+	do(http.MethodGet, "http://test.de/other")
+	if c.Length() != 3 {
+		t.Fatalf("cache length is bad, got=%d", c.Length())
+	}
+
+	do(http.MethodPost, "http://test.de/items")
+	do(http.MethodPost, "http://test.de/items")
+	if calls != 5 {
+		t.Fatalf("upstream calls are bad, got=%d", calls)
+	}
+
+	if c.Length() != 1 {
+		t.Fatalf("cache length is bad, got=%d", c.Length())
+	}
+}
+
+func TestCacheTransport_CachePOSTInvalidates(t *testing.T) {
+	var calls int
+	c := cache.NewLRUCache(1*size.MB, 0)
+	transport := &CacheTransport{
+		Cache:     c,
+		CachePOST: true,
+		Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			calls++
+			resp := &http.Response{StatusCode: http.StatusOK, Header: make(http.Header), Body: http.NoBody, Request: req}
+			if req.Method == http.MethodPost {
+				resp.StatusCode = http.StatusCreated
+				resp.Header.Set("Location", "/items/1")
+			}
+			return resp, nil
+		}),
+	}
+
+	do := func(method, url string) {
+		req, err := http.NewRequest(method, url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := transport.RoundTrip(req); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	do(http.MethodGet, "http://test.de/items")
+	do(http.MethodGet, "http://test.de/items/1")
+	do(http.MethodPost, "http://test.de/items")
+	do(http.MethodGet, "http://test.de/items")
+	do(http.MethodGet, "http://test.de/items/1")
+	if calls != 5 {
+		t.Fatalf("upstream calls are bad, got=%d", calls)
+	}
+}
+
+func TestCacheTransport_Head(t *testing.T) {
+	var calls int
+	transport := &CacheTransport{
+		Cache: cache.NewLRUCache(1*size.MB, 0),
+		Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			calls++
+			body := `{"count": 10}`
+			return &http.Response{
+				StatusCode:    http.StatusOK,
+				Header:        http.Header{"Content-Length": {strconv.Itoa(len(body))}},
+				ContentLength: int64(len(body)),
+				Body:          ioutil.NopCloser(strings.NewReader(body)),
+				Request:       req,
+			}, nil
+		}),
+	}
+
+	for _, method := range []string{http.MethodGet, http.MethodHead, http.MethodGet} {
+		req, err := http.NewRequest(method, "http://test.de", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp, err := transport.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.ContentLength != 13 {
+			t.Fatalf("content length of %s is bad, got=%d", method, resp.ContentLength)
+		}
+
+		if method == http.MethodHead && len(body) != 0 {
+			t.Fatalf("body of %s is bad, got=%s", method, body)
+		}
+
+		if method == http.MethodGet && string(body) != `{"count": 10}` {
+			t.Fatalf("body of %s is bad, got=%s", method, body)
+		}
+	}
+
+	if calls != 1 {
+		t.Fatalf("upstream calls are bad, got=%d", calls)
+	}
+}
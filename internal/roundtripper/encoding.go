@@ -0,0 +1,114 @@
+package roundtripper
+
+import (
+	"bytes"
+	"compress/gzip"
+	"github.com/donutloop/httpcache/internal/cache"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// minCompressSize is the body size below which compression doesn't pay off.
+const minCompressSize = 256
+
+// compress gzips the body of a cached response, if it isn't encoded
+// already and the origin doesn't forbid transformations. Bodies which don't
+// get smaller are stored unchanged.
+func compress(cachedResponse *cache.CachedResponse) error {
+	if len(cachedResponse.Body) < minCompressSize || cachedResponse.Resp.Header.Get("Content-Encoding") != "" {
+		return nil
+	}
+	if hasDirective(cachedResponse.Resp.Header, "no-transform") {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(cachedResponse.Body); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	if buf.Len() >= len(cachedResponse.Body) {
+		return nil
+	}
+	cachedResponse.Body = buf.Bytes()
+	cachedResponse.Encoding = "gzip"
+	return nil
+}
+
+// hasDirective reports whether the Cache-Control header carries the directive.
+func hasDirective(header http.Header, directive string) bool {
+	for _, v := range strings.Split(header.Get("Cache-Control"), ",") {
+		if strings.EqualFold(strings.TrimSpace(v), directive) {
+			return true
+		}
+	}
+	return false
+}
+
+// encodedResponse answers the request with the compressed body of the
+// cached response. The compressed form isn't byte for byte the one of the
+// origin, so a strong ETag is weakened.
+func encodedResponse(req *http.Request, cachedResponse *cache.CachedResponse) *http.Response {
+	resp := cachedResponse.Response(req)
+	resp.Header.Set("Content-Encoding", cachedResponse.Encoding)
+	resp.Header.Set("Content-Length", strconv.Itoa(len(cachedResponse.Body)))
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		resp.Header.Set("ETag", "W/"+etag)
+	}
+	varyAcceptEncoding(resp.Header)
+	return resp
+}
+
+// varyAcceptEncoding adds Accept-Encoding to the Vary header of responses
+// whose form depends on it, unless it's listed already.
+func varyAcceptEncoding(header http.Header) {
+	for _, v := range header["Vary"] {
+		for _, field := range strings.Split(v, ",") {
+			if field = strings.TrimSpace(field); field == "*" || strings.EqualFold(field, "Accept-Encoding") {
+				return
+			}
+		}
+	}
+	header.Add("Vary", "Accept-Encoding")
+}
+
+// decode returns a copy of the cached response with a decompressed body.
+func decode(cachedResponse *cache.CachedResponse) (*cache.CachedResponse, error) {
+	r, err := gzip.NewReader(bytes.NewReader(cachedResponse.Body))
+	if err != nil {
+		return nil, err
+	}
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	decoded := *cachedResponse
+	decoded.Body = body
+	decoded.Encoding = ""
+	return &decoded, nil
+}
+
+// acceptsEncoding reports whether the Accept-Encoding header of the request
+// allows the content coding.
+func acceptsEncoding(req *http.Request, encoding string) bool {
+	for _, v := range strings.Split(req.Header.Get("Accept-Encoding"), ",") {
+		parts := strings.Split(v, ";")
+		if !strings.EqualFold(strings.TrimSpace(parts[0]), encoding) {
+			continue
+		}
+		for _, param := range parts[1:] {
+			if q := strings.Replace(strings.TrimSpace(param), " ", "", -1); q == "q=0" || q == "q=0.0" || q == "q=0.00" || q == "q=0.000" {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
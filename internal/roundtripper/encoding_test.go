@@ -0,0 +1,105 @@
+package roundtripper
+
+import (
+	"github.com/donutloop/httpcache/internal/cache"
+	"github.com/donutloop/httpcache/internal/size"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestCacheTransport_Compress(t *testing.T) {
+	object := strings.Repeat(`{"count": 10}`, 100)
+
+	c := cache.NewLRUCache(1*size.MB, 0)
+	transport := &CacheTransport{
+		Cache:    c,
+		Compress: true,
+		Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Header:     http.Header{"Content-Type": {"application/json"}, "Etag": {`"v1"`}},
+				Body:       ioutil.NopCloser(strings.NewReader(object)),
+				Request:    req,
+			}, nil
+		}),
+	}
+
+	for _, acceptEncoding := range []string{"gzip", "", "gzip;q=0", "br, gzip"} {
+		req, err := http.NewRequest(http.MethodGet, "http://test.de", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+
+		resp, err := transport.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		gzipped := resp.Header.Get("Content-Encoding") == "gzip"
+		if gzipped != acceptsEncoding(req, "gzip") {
+			t.Fatalf("content encoding for %q is bad, got=%q", acceptEncoding, resp.Header.Get("Content-Encoding"))
+		}
+
+		if !gzipped && string(body) != object {
+			t.Fatalf("body for %q is bad, got=%s", acceptEncoding, body)
+		}
+
+		if gzipped && len(body) >= len(object) {
+			t.Fatalf("body for %q isn't compressed, got=%d bytes", acceptEncoding, len(body))
+		}
+
+		etag := `"v1"`
+		if gzipped {
+			etag = `W/"v1"`
+		}
+		if resp.Header.Get("ETag") != etag || resp.Header.Get("Vary") != "Accept-Encoding" {
+			t.Fatalf("headers for %q are bad, got=(%s, %s)", acceptEncoding, resp.Header.Get("ETag"), resp.Header.Get("Vary"))
+		}
+	}
+
+	if c.Size() >= int64(len(object)) {
+		t.Fatalf("cache size is bad, got=%d", c.Size())
+	}
+}
+
+func TestCacheTransport_CompressNoTransform(t *testing.T) {
+	object := strings.Repeat(`{"count": 10}`, 100)
+
+	c := cache.NewLRUCache(1*size.MB, 0)
+	transport := &CacheTransport{
+		Cache:    c,
+		Compress: true,
+		Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Header:     http.Header{"Cache-Control": {"max-age=60, no-transform"}},
+				Body:       ioutil.NopCloser(strings.NewReader(object)),
+				Request:    req,
+			}, nil
+		}),
+	}
+
+	req, err := http.NewRequest(http.MethodGet, "http://test.de", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.Header.Get("Content-Encoding") != "" || c.Size() < int64(len(object)) {
+		t.Fatalf("response is transformed, got=(%q, %d bytes)", resp.Header.Get("Content-Encoding"), c.Size())
+	}
+}
@@ -0,0 +1,35 @@
+package roundtripper
+
+import (
+	"net/http"
+	"strings"
+)
+
+// hopHeaders apply to a single connection and aren't forwarded by proxies
+// (RFC 9110 section 7.6.1).
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection", // non-standard, sent by older clients
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// RemoveHopHeaders removes the hop-by-hop headers and the headers listed in
+// the Connection header.
+func RemoveHopHeaders(h http.Header) {
+	for _, v := range h["Connection"] {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
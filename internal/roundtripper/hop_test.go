@@ -0,0 +1,24 @@
+package roundtripper
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestRemoveHopHeaders(t *testing.T) {
+	h := http.Header{}
+	h.Set("Connection", "keep-alive, X-Session")
+	h.Set("X-Session", "1")
+	h.Set("Keep-Alive", "timeout=5")
+	h.Set("Proxy-Connection", "keep-alive")
+	h.Set("Proxy-Authorization", "Basic dXNlcjpzZWNyZXQ=")
+	h.Set("Te", "trailers")
+	h.Set("Upgrade", "websocket")
+	h.Set("Content-Type", "text/plain")
+
+	RemoveHopHeaders(h)
+
+	if len(h) != 1 || h.Get("Content-Type") != "text/plain" {
+		t.Fatalf("headers are bad, got=%v", h)
+	}
+}
@@ -2,6 +2,8 @@ package roundtripper
 
 import (
 	"fmt"
+	"github.com/donutloop/httpcache/internal/auth"
+	"github.com/donutloop/httpcache/internal/har"
 	"net/http"
 	"time"
 )
@@ -10,18 +12,32 @@ import (
 type LoggedTransport struct {
 	Logger    func(v ...interface{})
 	Transport http.RoundTripper // underlying transport (or default if nil)
+
+	// Recorder keeps the recent exchanges with their timings for the HAR
+	// export (optional).
+	Recorder *har.Recorder
 }
 
 func (t *LoggedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
 
+	var user string
+	if identity := auth.Identity(req.Context()); identity != "" {
+		user = " user=" + identity
+	}
+
 	start := time.Now()
 	resp, err := t.Transport.RoundTrip(req)
 	if err != nil {
-		t.Logger(fmt.Sprintf("HTTP %s %s: error: %s\n", req.Method, req.URL, err))
+		t.Logger(fmt.Sprintf("HTTP %s %s%s: error: %s\n", req.Method, req.URL, user, err))
 		return nil, err
 	}
 
-	t.Logger(fmt.Sprintf("HTTP %s %s %d [%s rtt]\n", req.Method, req.URL, resp.StatusCode, time.Since(start)))
+	rtt := time.Since(start)
+	t.Logger(fmt.Sprintf("HTTP %s %s %d%s [%s rtt]\n", req.Method, req.URL, resp.StatusCode, user, rtt))
+
+	if t.Recorder != nil {
+		t.Recorder.Record(req, resp, start, rtt)
+	}
 
 	return resp, nil
 }
@@ -0,0 +1,31 @@
+package roundtripper
+
+import (
+	"context"
+	"net/http"
+)
+
+// CachePolicy overrides the cache settings of the CacheTransport for a
+// single request, e.g. for a route of the reverse proxy.
+type CachePolicy struct {
+	// NoCache passes the request through without caching.
+	NoCache bool
+
+	// StatusTTL replaces the status ttl table of the transport, if set.
+	StatusTTL StatusTTL
+}
+
+type cachePolicyKey struct{}
+
+// WithCachePolicy returns a copy of the context which carries the cache policy.
+func WithCachePolicy(ctx context.Context, policy *CachePolicy) context.Context {
+	return context.WithValue(ctx, cachePolicyKey{}, policy)
+}
+
+func cachePolicy(req *http.Request) *CachePolicy {
+	policy, _ := req.Context().Value(cachePolicyKey{}).(*CachePolicy)
+	if policy == nil {
+		return &CachePolicy{}
+	}
+	return policy
+}
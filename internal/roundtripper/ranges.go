@@ -0,0 +1,213 @@
+package roundtripper
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/donutloop/httpcache/internal/cache"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errRangeNotSatisfiable = errors.New("range is not satisfiable")
+
+// maxRanges is the number of ranges a multipart response may have, requests
+// asking for more get the complete response.
+const maxRanges = 16
+
+// httpRange is a byte range of a representation.
+type httpRange struct {
+	start, length int64
+}
+
+func (r httpRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, size)
+}
+
+// statusLine returns the Status of a response, e.g. "206 Partial Content".
+func statusLine(code int) string {
+	return fmt.Sprintf("%d %s", code, http.StatusText(code))
+}
+
+// rangeResponse answers a range request from a complete cached response.
+// Range headers which can't be parsed or which don't match If-Range are
+// ignored and the complete response is returned (RFC 9110 section 14.2).
+// So are headers asking for more than maxRanges ranges or, like net/http
+// does, for more bytes than the representation has.
+func rangeResponse(req *http.Request, cachedResponse *cache.CachedResponse) *http.Response {
+	resp := cachedResponse.Response(req)
+	if resp.StatusCode != http.StatusOK || !ifRangeMatches(req.Header.Get("If-Range"), resp.Header) {
+		return resp
+	}
+
+	size := int64(len(cachedResponse.Body))
+	ranges, err := parseRange(req.Header.Get("Range"), size)
+	if err == errRangeNotSatisfiable {
+		resp.StatusCode = http.StatusRequestedRangeNotSatisfiable
+		resp.Status = statusLine(http.StatusRequestedRangeNotSatisfiable)
+		resp.Header.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		setBody(resp, nil)
+		return resp
+	}
+	if err != nil || len(ranges) == 0 || sumRangesSize(ranges) > size {
+		return resp
+	}
+	ranges = mergeRanges(ranges)
+	if len(ranges) > maxRanges {
+		return resp
+	}
+
+	resp.StatusCode = http.StatusPartialContent
+	resp.Status = statusLine(http.StatusPartialContent)
+
+	if len(ranges) == 1 {
+		r := ranges[0]
+		resp.Header.Set("Content-Range", r.contentRange(size))
+		setBody(resp, cachedResponse.Body[r.start:r.start+r.length])
+		return resp
+	}
+
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	contentType := resp.Header.Get("Content-Type")
+	for _, r := range ranges {
+		header := textproto.MIMEHeader{"Content-Range": {r.contentRange(size)}}
+		if contentType != "" {
+			header.Set("Content-Type", contentType)
+		}
+		part, err := w.CreatePart(header)
+		if err != nil {
+			return cachedResponse.Response(req)
+		}
+		part.Write(cachedResponse.Body[r.start : r.start+r.length])
+	}
+	w.Close()
+
+	resp.Header.Set("Content-Type", "multipart/byteranges; boundary="+w.Boundary())
+	setBody(resp, body.Bytes())
+	return resp
+}
+
+func sumRangesSize(ranges []httpRange) (size int64) {
+	for _, r := range ranges {
+		size += r.length
+	}
+	return size
+}
+
+// mergeRanges sorts the ranges and coalesces overlapping or adjacent ones.
+func mergeRanges(ranges []httpRange) []httpRange {
+	sorted := make([]httpRange, len(ranges))
+	copy(sorted, ranges)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].start < sorted[j].start })
+
+	merged := sorted[:1]
+	for _, r := range sorted[1:] {
+		last := &merged[len(merged)-1]
+		if r.start > last.start+last.length {
+			merged = append(merged, r)
+			continue
+		}
+		if end := r.start + r.length; end > last.start+last.length {
+			last.length = end - last.start
+		}
+	}
+	return merged
+}
+
+func setBody(resp *http.Response, body []byte) {
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+}
+
+// ifRangeMatches reports whether the If-Range validator matches the cached
+// representation, an entity tag must match strongly and a date exactly.
+func ifRangeMatches(ifRange string, header http.Header) bool {
+	if ifRange == "" {
+		return true
+	}
+
+	if strings.HasPrefix(ifRange, `"`) {
+		etag := header.Get("ETag")
+		return etag != "" && !strings.HasPrefix(etag, "W/") && etag == ifRange
+	}
+
+	date, err := http.ParseTime(ifRange)
+	if err != nil {
+		return false
+	}
+	lastModified, err := http.ParseTime(header.Get("Last-Modified"))
+	return err == nil && lastModified.Equal(date.Truncate(time.Second))
+}
+
+// parseRange parses a Range header like "bytes=0-99,-100" against a
+// representation of the given size. Ranges beyond the size are dropped,
+// if none remains the range is not satisfiable.
+func parseRange(s string, size int64) ([]httpRange, error) {
+	const prefix = "bytes="
+	if !strings.HasPrefix(s, prefix) {
+		return nil, errors.New("invalid range")
+	}
+
+	var ranges []httpRange
+	for _, spec := range strings.Split(s[len(prefix):], ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+
+		i := strings.Index(spec, "-")
+		if i < 0 {
+			return nil, errors.New("invalid range")
+		}
+		first, last := strings.TrimSpace(spec[:i]), strings.TrimSpace(spec[i+1:])
+
+		var r httpRange
+		if first == "" {
+			// suffix range, the last n bytes
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || n < 0 {
+				return nil, errors.New("invalid range")
+			}
+			if n == 0 || size == 0 {
+				continue
+			}
+			if n > size {
+				n = size
+			}
+			r = httpRange{start: size - n, length: n}
+		} else {
+			start, err := strconv.ParseInt(first, 10, 64)
+			if err != nil || start < 0 {
+				return nil, errors.New("invalid range")
+			}
+			if start >= size {
+				continue
+			}
+			end := size - 1
+			if last != "" {
+				end, err = strconv.ParseInt(last, 10, 64)
+				if err != nil || end < start {
+					return nil, errors.New("invalid range")
+				}
+				if end >= size {
+					end = size - 1
+				}
+			}
+			r = httpRange{start: start, length: end - start + 1}
+		}
+		ranges = append(ranges, r)
+	}
+
+	if len(ranges) == 0 {
+		return nil, errRangeNotSatisfiable
+	}
+	return ranges, nil
+}
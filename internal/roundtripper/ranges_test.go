@@ -0,0 +1,139 @@
+package roundtripper
+
+import (
+	"fmt"
+	"github.com/donutloop/httpcache/internal/cache"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		header string
+		ranges []httpRange
+		err    bool
+	}{
+		{header: "bytes=0-4", ranges: []httpRange{{0, 5}}},
+		{header: "bytes=5-", ranges: []httpRange{{5, 5}}},
+		{header: "bytes=-3", ranges: []httpRange{{7, 3}}},
+		{header: "bytes=0-0,8-20", ranges: []httpRange{{0, 1}, {8, 2}}},
+		{header: "bytes=10-", err: true},
+		{header: "bytes=4-2", err: true},
+		{header: "items=0-4", err: true},
+	}
+
+	for _, test := range tests {
+		ranges, err := parseRange(test.header, 10)
+		if (err != nil) != test.err {
+			t.Errorf("error of %q is bad (%v)", test.header, err)
+			continue
+		}
+		if len(ranges) != len(test.ranges) {
+			t.Errorf("ranges of %q are bad, got=%v", test.header, ranges)
+			continue
+		}
+		for i := range ranges {
+			if ranges[i] != test.ranges[i] {
+				t.Errorf("ranges of %q are bad, got=%v", test.header, ranges)
+			}
+		}
+	}
+}
+
+func TestMergeRanges(t *testing.T) {
+	tests := []struct {
+		ranges []httpRange
+		merged []httpRange
+	}{
+		{ranges: []httpRange{{0, 5}}, merged: []httpRange{{0, 5}}},
+		{ranges: []httpRange{{5, 5}, {0, 2}}, merged: []httpRange{{0, 2}, {5, 5}}},
+		{ranges: []httpRange{{0, 5}, {5, 5}}, merged: []httpRange{{0, 10}}},
+		{ranges: []httpRange{{2, 3}, {0, 10}, {4, 1}}, merged: []httpRange{{0, 10}}},
+	}
+
+	for _, test := range tests {
+		merged := mergeRanges(test.ranges)
+		if len(merged) != len(test.merged) {
+			t.Errorf("merged ranges of %v are bad, got=%v", test.ranges, merged)
+			continue
+		}
+		for i := range merged {
+			if merged[i] != test.merged[i] {
+				t.Errorf("merged ranges of %v are bad, got=%v", test.ranges, merged)
+			}
+		}
+	}
+}
+
+func TestRangeResponse(t *testing.T) {
+	cachedResponse := &cache.CachedResponse{
+		Resp: &http.Response{
+			Status:     "200 OK",
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Etag": {`"v1"`}, "Content-Type": {"text/plain"}},
+		},
+		Body: []byte("0123456789"),
+	}
+
+	tests := []struct {
+		rangeHeader string
+		ifRange     string
+		status      int
+		body        string
+	}{
+		{rangeHeader: "bytes=2-4", status: http.StatusPartialContent, body: "234"},
+		{rangeHeader: "bytes=2-4", ifRange: `"v1"`, status: http.StatusPartialContent, body: "234"},
+		{rangeHeader: "bytes=2-4", ifRange: `"v2"`, status: http.StatusOK, body: "0123456789"},
+		{rangeHeader: "bytes=20-", status: http.StatusRequestedRangeNotSatisfiable, body: ""},
+		{rangeHeader: "bytes=0-2,2-4,4-5", status: http.StatusPartialContent, body: "012345"},
+		{rangeHeader: "bytes=0-," + strings.Repeat("0-,", 500), status: http.StatusOK, body: "0123456789"},
+		{rangeHeader: "bytes=" + strings.Repeat("1-1,", 5), status: http.StatusPartialContent, body: "1"},
+		{rangeHeader: "bytes=" + strings.Repeat("1-1,", 20), status: http.StatusOK, body: "0123456789"},
+	}
+
+	for _, test := range tests {
+		req, err := http.NewRequest(http.MethodGet, "http://test.de", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Range", test.rangeHeader)
+		if test.ifRange != "" {
+			req.Header.Set("If-Range", test.ifRange)
+		}
+
+		resp := rangeResponse(req, cachedResponse)
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.StatusCode != test.status || resp.Status != statusLine(test.status) || string(body) != test.body {
+			t.Errorf("response of %q is bad, got=(%s, %s)", test.rangeHeader, resp.Status, body)
+		}
+	}
+
+	req, err := http.NewRequest(http.MethodGet, "http://test.de", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Range", "bytes=0-1,-2")
+
+	resp := rangeResponse(req, cachedResponse)
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "multipart/byteranges; boundary=") {
+		t.Fatalf("content type is bad, got=%s", resp.Header.Get("Content-Type"))
+	}
+
+	var ranges []string
+	for i := 0; i <= maxRanges; i++ {
+		ranges = append(ranges, fmt.Sprintf("%d-%d", 2*i, 2*i))
+	}
+	cachedResponse.Body = []byte(strings.Repeat("0123456789", 4))
+	req.Header.Set("Range", "bytes="+strings.Join(ranges, ","))
+
+	resp = rangeResponse(req, cachedResponse)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status code of %d ranges is bad, got=%d", len(ranges), resp.StatusCode)
+	}
+}
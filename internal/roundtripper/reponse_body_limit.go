@@ -19,6 +19,9 @@ func (t *ResponseBodyLimitRoundTripper) RoundTrip(req *http.Request) (*http.Resp
 	}
 
 	if response.ContentLength > t.Limit {
+		// the body is closed, so that the connection and the slots of the
+		// origin are released
+		response.Body.Close()
 		return nil, ResponseIsToLarge
 	}
 
@@ -0,0 +1,249 @@
+package roundtripper
+
+import (
+	"fmt"
+	"github.com/donutloop/httpcache/internal/cache"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// roundTripSliced fetches the first slice of the object with a range request.
+// Objects larger than a slice are cached slice by slice, the remaining slices
+// are fetched as they are read. Objects which fit into a slice, or whose
+// origin doesn't support ranges, are cached as a whole.
+func (t *CacheTransport) roundTripSliced(req *http.Request, key string) (*http.Response, error) {
+	if meta, ok := t.get(sliceMetaKey(key)); ok {
+		return t.slicedResponse(req, key, meta), nil
+	}
+
+	upstreamRequest := withoutRange(req)
+	probeRequest := withoutRange(req)
+	probeRequest.Header.Set("Range", fmt.Sprintf("bytes=0-%d", t.SliceSize-1))
+
+	proxyResponse, err := t.Transport.RoundTrip(probeRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	if proxyResponse.StatusCode == http.StatusPartialContent {
+		start, _, total, ok := parseContentRange(proxyResponse.Header.Get("Content-Range"))
+		if !ok || start != 0 {
+			proxyResponse.Body.Close()
+			return t.Transport.RoundTrip(req)
+		}
+
+		proxyResponse.StatusCode = http.StatusOK
+		proxyResponse.Status = statusLine(http.StatusOK)
+		proxyResponse.Header.Del("Content-Range")
+		proxyResponse.Header.Set("Content-Length", strconv.FormatInt(total, 10))
+
+		if total > t.SliceSize {
+			proxyResponse.ContentLength = total
+			return t.storeSliced(req, key, proxyResponse)
+		}
+	}
+
+	cachedResponse, err := t.store(key, upstreamRequest, proxyResponse)
+	if err != nil {
+		return nil, err
+	}
+	if cachedResponse == nil {
+		return proxyResponse, nil
+	}
+	return t.respond(req, cachedResponse)
+}
+
+// storeSliced caches the first slice and the slice meta entry of the object,
+// which holds the status line and headers of the complete object.
+func (t *CacheTransport) storeSliced(req *http.Request, key string, proxyResponse *http.Response) (*http.Response, error) {
+	expires, ok := t.expires(req, proxyResponse)
+	if !ok {
+		proxyResponse.Body.Close()
+		return t.Transport.RoundTrip(req)
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(proxyResponse.Body, t.SliceSize))
+	proxyResponse.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) != t.SliceSize {
+		return nil, fmt.Errorf("first slice of %s is bad, got=%d bytes", req.URL, len(body))
+	}
+
+	meta := &cache.CachedResponse{
+		Resp:      storedResponse(proxyResponse),
+		URL:       cacheURL(req.URL),
+		Method:    req.Method,
+		SliceSize: t.SliceSize,
+		Expires:   expires,
+	}
+
+	t.Cache.Set(sliceKey(key, 0), &cache.CachedResponse{Resp: meta.Resp, Body: body, URL: meta.URL, Method: meta.Method, Expires: expires})
+	t.Cache.Set(sliceMetaKey(key), meta)
+	return t.slicedResponse(req, key, meta), nil
+}
+
+// slicedResponse answers the request from a sliced object, single ranges are
+// served as well.
+func (t *CacheTransport) slicedResponse(req *http.Request, key string, meta *cache.CachedResponse) *http.Response {
+	total := meta.Resp.ContentLength
+	resp := meta.Response(req)
+	resp.ContentLength = total
+	if req.Method == http.MethodHead {
+		return resp
+	}
+
+	start, end := int64(0), total
+	if h := req.Header.Get("Range"); h != "" && ifRangeMatches(req.Header.Get("If-Range"), resp.Header) {
+		ranges, err := parseRange(h, total)
+		if err == errRangeNotSatisfiable {
+			resp.StatusCode = http.StatusRequestedRangeNotSatisfiable
+			resp.Status = statusLine(http.StatusRequestedRangeNotSatisfiable)
+			resp.Header.Set("Content-Range", fmt.Sprintf("bytes */%d", total))
+			setBody(resp, nil)
+			return resp
+		}
+		// multiple ranges aren't supported for sliced objects, the complete
+		// object is a valid answer as well
+		if err == nil && len(ranges) == 1 {
+			start, end = ranges[0].start, ranges[0].start+ranges[0].length
+			resp.StatusCode = http.StatusPartialContent
+			resp.Status = statusLine(http.StatusPartialContent)
+			resp.Header.Set("Content-Range", ranges[0].contentRange(total))
+			resp.Header.Set("Content-Length", strconv.FormatInt(ranges[0].length, 10))
+			resp.ContentLength = ranges[0].length
+		}
+	}
+
+	resp.Body = &sliceReader{
+		t:      t,
+		req:    withoutRange(req),
+		key:    key,
+		meta:   meta,
+		offset: start,
+		end:    end,
+	}
+	return resp
+}
+
+// slice returns the i-th slice of the object, it is fetched and cached on a miss.
+func (t *CacheTransport) slice(req *http.Request, key string, meta *cache.CachedResponse, i int64) ([]byte, error) {
+	if cachedResponse, ok := t.get(sliceKey(key, i)); ok {
+		return cachedResponse.Body, nil
+	}
+
+	start := i * meta.SliceSize
+	end := start + meta.SliceSize
+	if total := meta.Resp.ContentLength; end > total {
+		end = total
+	}
+
+	sliceRequest := withoutRange(req)
+	sliceRequest.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end-1))
+	proxyResponse, err := t.Transport.RoundTrip(sliceRequest)
+	if err != nil {
+		return nil, err
+	}
+	defer proxyResponse.Body.Close()
+
+	if proxyResponse.StatusCode != http.StatusPartialContent {
+		return nil, fmt.Errorf("slice %d of %s is bad, got status %d", i, meta.URL, proxyResponse.StatusCode)
+	}
+	if etag := meta.Resp.Header.Get("ETag"); etag != "" && proxyResponse.Header.Get("ETag") != etag {
+		return nil, fmt.Errorf("slice %d of %s is bad, the object has changed", i, meta.URL)
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(proxyResponse.Body, end-start))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) != end-start {
+		return nil, fmt.Errorf("slice %d of %s is bad, got=%d bytes", i, meta.URL, len(body))
+	}
+
+	if !meta.Expired(time.Now()) {
+		t.Cache.Set(sliceKey(key, i), &cache.CachedResponse{Resp: meta.Resp, Body: body, URL: meta.URL, Method: meta.Method, Expires: meta.Expires})
+	}
+	return body, nil
+}
+
+// sliceReader reads the bytes [offset, end) of a sliced object.
+type sliceReader struct {
+	t           *CacheTransport
+	req         *http.Request // template of the upstream slice requests
+	key         string
+	meta        *cache.CachedResponse
+	offset, end int64
+	buf         []byte // unread bytes of the current slice
+}
+
+func (r *sliceReader) Read(p []byte) (int, error) {
+	if r.offset >= r.end {
+		return 0, io.EOF
+	}
+
+	if len(r.buf) == 0 {
+		slice, err := r.t.slice(r.req, r.key, r.meta, r.offset/r.meta.SliceSize)
+		if err != nil {
+			return 0, err
+		}
+		start := r.offset % r.meta.SliceSize
+		stop := start + r.end - r.offset
+		if stop > int64(len(slice)) {
+			stop = int64(len(slice))
+		}
+		r.buf = slice[start:stop]
+	}
+
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	r.offset += int64(n)
+	return n, nil
+}
+
+func (r *sliceReader) Close() error {
+	return nil
+}
+
+func sliceMetaKey(key string) string {
+	return key + "/slices"
+}
+
+func sliceKey(key string, i int64) string {
+	return key + "/" + strconv.FormatInt(i, 10)
+}
+
+// parseContentRange parses a Content-Range header like "bytes 0-99/1234",
+// the complete length has to be known.
+func parseContentRange(s string) (start, end, total int64, ok bool) {
+	const prefix = "bytes "
+	if !strings.HasPrefix(s, prefix) {
+		return 0, 0, 0, false
+	}
+
+	parts := strings.SplitN(s[len(prefix):], "/", 2)
+	if len(parts) != 2 {
+		return 0, 0, 0, false
+	}
+	bounds := strings.SplitN(parts[0], "-", 2)
+	if len(bounds) != 2 {
+		return 0, 0, 0, false
+	}
+
+	var err error
+	if start, err = strconv.ParseInt(bounds[0], 10, 64); err != nil {
+		return 0, 0, 0, false
+	}
+	if end, err = strconv.ParseInt(bounds[1], 10, 64); err != nil || end < start {
+		return 0, 0, 0, false
+	}
+	if total, err = strconv.ParseInt(parts[1], 10, 64); err != nil || total <= end {
+		return 0, 0, 0, false
+	}
+	return start, end, total, true
+}
@@ -0,0 +1,70 @@
+package roundtripper
+
+import (
+	"bytes"
+	"github.com/donutloop/httpcache/internal/cache"
+	"github.com/donutloop/httpcache/internal/size"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCacheTransport_Slices(t *testing.T) {
+	object := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+
+	var ranges []string
+	c := cache.NewLRUCache(1*size.MB, 0)
+	transport := &CacheTransport{
+		Cache:     c,
+		SliceSize: 10,
+		Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			ranges = append(ranges, req.Header.Get("Range"))
+			recorder := httptest.NewRecorder()
+			http.ServeContent(recorder, req, "object", time.Time{}, bytes.NewReader(object))
+			return recorder.Result(), nil
+		}),
+	}
+
+	get := func(rangeHeader string) (*http.Response, string) {
+		req, err := http.NewRequest(http.MethodGet, "http://test.de/object", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rangeHeader != "" {
+			req.Header.Set("Range", rangeHeader)
+		}
+
+		resp, err := transport.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp, string(body)
+	}
+
+	resp, body := get("bytes=12-21")
+	if resp.Status != "206 Partial Content" || body != "cdefghijkl" {
+		t.Fatalf("response is bad, got=(%s, %s)", resp.Status, body)
+	}
+
+	resp, body = get("")
+	if resp.Status != "200 OK" || body != string(object) {
+		t.Fatalf("response is bad, got=(%s, %s)", resp.Status, body)
+	}
+
+	// probe, slice 1, slice 2 and finally slice 3
+	if len(ranges) != 4 {
+		t.Fatalf("upstream ranges are bad, got=%v", ranges)
+	}
+
+	// meta entry and four slices
+	if c.Length() != 5 {
+		t.Fatalf("cache length is bad, got=%d", c.Length())
+	}
+}
@@ -0,0 +1,140 @@
+package roundtripper
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FromHeaders is a ttl value which derives the lifetime of a cached
+// response from its Cache-Control and Expires headers.
+const FromHeaders time.Duration = -1
+
+// StatusTTL maps response status codes (e.g. "404") or status classes
+// (e.g. "5xx") to how long such responses are kept in the cache. A ttl of
+// zero disables caching for the status, FromHeaders uses the response headers.
+// Statuses which aren't listed are cached until they get evicted.
+type StatusTTL map[string]time.Duration
+
+// String returns the table in the flag format, e.g. "404=1m0s,5xx=0s,301=header".
+func (s StatusTTL) String() string {
+	keys := make([]string, 0, len(s))
+	for k := range s {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		v := s[k].String()
+		if s[k] == FromHeaders {
+			v = "header"
+		}
+		pairs = append(pairs, k+"="+v)
+	}
+	return strings.Join(pairs, ",")
+}
+
+// Set parses a comma separated list of status=ttl pairs and adds them to the table.
+func (s StatusTTL) Set(value string) error {
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("status ttl %q is not of the form status=ttl", pair)
+		}
+
+		status := strings.ToLower(strings.TrimSpace(kv[0]))
+		if !isStatusKey(status) {
+			return fmt.Errorf("status %q is neither a status code nor a status class like 5xx", status)
+		}
+
+		v := strings.TrimSpace(kv[1])
+		if v == "header" {
+			s[status] = FromHeaders
+			continue
+		}
+
+		ttl, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("status ttl of %q is bad (%v)", status, err)
+		}
+		if ttl < 0 {
+			return fmt.Errorf("status ttl of %q is negative", status)
+		}
+		s[status] = ttl
+	}
+	return nil
+}
+
+// Lookup returns the ttl of the status code, an exact status code match
+// has precedence over its status class.
+func (s StatusTTL) Lookup(code int) (time.Duration, bool) {
+	if ttl, ok := s[strconv.Itoa(code)]; ok {
+		return ttl, true
+	}
+	ttl, ok := s[fmt.Sprintf("%dxx", code/100)]
+	return ttl, ok
+}
+
+func isStatusKey(status string) bool {
+	if len(status) != 3 || status[0] < '1' || status[0] > '5' {
+		return false
+	}
+	if status[1:] == "xx" {
+		return true
+	}
+	_, err := strconv.Atoi(status)
+	return err == nil
+}
+
+// freshness returns how long the response may be cached according to its
+// Cache-Control and Expires headers, zero if it may not be cached.
+func freshness(header http.Header, now time.Time) time.Duration {
+	var maxAge, sharedMaxAge time.Duration = -1, -1
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		directive = strings.ToLower(strings.TrimSpace(directive))
+		switch {
+		case directive == "no-store", directive == "no-cache", directive == "private":
+			return 0
+		case strings.HasPrefix(directive, "s-maxage="):
+			sharedMaxAge = parseSeconds(strings.TrimPrefix(directive, "s-maxage="))
+		case strings.HasPrefix(directive, "max-age="):
+			maxAge = parseSeconds(strings.TrimPrefix(directive, "max-age="))
+		}
+	}
+
+	if sharedMaxAge >= 0 {
+		return sharedMaxAge
+	}
+	if maxAge >= 0 {
+		return maxAge
+	}
+
+	expires, err := http.ParseTime(header.Get("Expires"))
+	if err != nil {
+		return 0
+	}
+	if date, err := http.ParseTime(header.Get("Date")); err == nil {
+		now = date
+	}
+	if ttl := expires.Sub(now); ttl > 0 {
+		return ttl
+	}
+	return 0
+}
+
+func parseSeconds(v string) time.Duration {
+	seconds, err := strconv.ParseInt(strings.Trim(v, `"`), 10, 64)
+	if err != nil || seconds < 0 {
+		return -1
+	}
+	return time.Duration(seconds) * time.Second
+}
@@ -0,0 +1,64 @@
+package roundtripper
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestStatusTTL(t *testing.T) {
+	statusTTL := StatusTTL{}
+	if err := statusTTL.Set("404=1m, 5xx=0s,301=header"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		code int
+		ttl  time.Duration
+		ok   bool
+	}{
+		{code: http.StatusNotFound, ttl: time.Minute, ok: true},
+		{code: http.StatusBadGateway, ttl: 0, ok: true},
+		{code: http.StatusMovedPermanently, ttl: FromHeaders, ok: true},
+		{code: http.StatusOK, ttl: 0, ok: false},
+	}
+
+	for _, test := range tests {
+		ttl, ok := statusTTL.Lookup(test.code)
+		if ttl != test.ttl || ok != test.ok {
+			t.Errorf("lookup of %d is bad, got=(%v, %v), want=(%v, %v)", test.code, ttl, ok, test.ttl, test.ok)
+		}
+	}
+
+	if statusTTL.String() != "301=header,404=1m0s,5xx=0s" {
+		t.Errorf("string is bad, got=%s", statusTTL.String())
+	}
+
+	for _, value := range []string{"404", "600=1m", "4x=1m", "404=-1m", "404=soon"} {
+		if err := (StatusTTL{}).Set(value); err == nil {
+			t.Errorf("value %q is accepted", value)
+		}
+	}
+}
+
+func TestFreshness(t *testing.T) {
+	now := time.Date(2018, 10, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		header http.Header
+		ttl    time.Duration
+	}{
+		{header: http.Header{"Cache-Control": {"max-age=60"}}, ttl: time.Minute},
+		{header: http.Header{"Cache-Control": {"max-age=60, s-maxage=120"}}, ttl: 2 * time.Minute},
+		{header: http.Header{"Cache-Control": {"no-store, max-age=60"}}, ttl: 0},
+		{header: http.Header{"Expires": {now.Add(time.Hour).Format(http.TimeFormat)}}, ttl: time.Hour},
+		{header: http.Header{"Expires": {"0"}}, ttl: 0},
+		{header: http.Header{}, ttl: 0},
+	}
+
+	for _, test := range tests {
+		if ttl := freshness(test.header, now); ttl != test.ttl {
+			t.Errorf("freshness of %v is bad, got=%v, want=%v", test.header, ttl, test.ttl)
+		}
+	}
+}
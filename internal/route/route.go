@@ -0,0 +1,302 @@
+package route
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/donutloop/httpcache/internal/balancer"
+	"github.com/donutloop/httpcache/internal/roundtripper"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Route maps requests of a host and path prefix to an upstream origin, or
+// to a pool of origins which the requests are balanced across.
+//
+// A routes file is a JSON list of routes, e.g.
+//
+//	[
+//		{"host": "api.example.com", "prefix": "/v1/", "upstream": "http://10.0.0.1:8080", "status_ttl": "200=1m"},
+//		{"prefix": "/", "upstreams": ["http://10.0.0.2:8080", "http://10.0.0.3:8080"], "balance": "least-conn",
+//		 "health_check": {"path": "/healthz", "interval": "5s"}, "no_cache": true}
+//	]
+type Route struct {
+	// Host matches the Host header of the request without port, an empty
+	// host matches all hosts.
+	Host string `json:"host"`
+
+	// Prefix matches the beginning of the request path.
+	Prefix string `json:"prefix"`
+
+	// Upstream is the origin the requests are sent to.
+	Upstream string `json:"upstream"`
+
+	// Upstreams is a pool of origins, they share the path of the first one
+	// and have to serve the same paths.
+	Upstreams []string `json:"upstreams"`
+
+	// Balance is the policy which selects the origin of a request:
+	// "round-robin" (default), "least-conn" or "hash" of the request path.
+	Balance string `json:"balance"`
+
+	// MaxFails consecutive failures eject an origin for FailTimeout,
+	// by default 3 failures for 30s.
+	MaxFails    int    `json:"max_fails"`
+	FailTimeout string `json:"fail_timeout"`
+
+	// Retries is the number of other origins tried for failed idempotent
+	// requests and those answered with 502, 503 or 504, by default 1.
+	Retries int `json:"retries"`
+
+	// HealthCheck actively checks the origins, optional.
+	HealthCheck *HealthCheck `json:"health_check"`
+
+	// PreserveHost passes the Host header of the client to the upstream,
+	// by default it's rewritten to the host of the upstream.
+	PreserveHost bool `json:"preserve_host"`
+
+	// NoCache passes the requests of the route through without caching.
+	NoCache bool `json:"no_cache"`
+
+	// StatusTTL replaces the status ttl table for the route, e.g. "200=1m,404=10s".
+	StatusTTL string `json:"status_ttl"`
+
+	upstream *url.URL
+	pool     *balancer.Pool
+	policy   *roundtripper.CachePolicy
+}
+
+// HealthCheck requests Path on each origin every Interval (default 10s),
+// origins which don't answer with a 2xx or 3xx within Timeout (default 2s)
+// get no requests until they recover.
+type HealthCheck struct {
+	Path     string `json:"path"`
+	Interval string `json:"interval"`
+	Timeout  string `json:"timeout"`
+}
+
+func (r *Route) init() error {
+	upstreams := r.Upstreams
+	if r.Upstream != "" {
+		upstreams = append([]string{r.Upstream}, upstreams...)
+	}
+	if len(upstreams) == 0 {
+		return fmt.Errorf("route has no upstream")
+	}
+
+	origins := make([]*url.URL, 0, len(upstreams))
+	for _, v := range upstreams {
+		upstream, err := url.Parse(v)
+		if err != nil {
+			return fmt.Errorf("upstream %q is bad (%v)", v, err)
+		}
+		if (upstream.Scheme != "http" && upstream.Scheme != "https") || upstream.Host == "" {
+			return fmt.Errorf("upstream %q is not an absolute http or https url", v)
+		}
+		// the requests are rewritten to the path of the first origin, the
+		// balancer only swaps the host
+		if len(origins) > 0 && strings.TrimSuffix(upstream.Path, "/") != strings.TrimSuffix(origins[0].Path, "/") {
+			return fmt.Errorf("upstream %q has another path than %q, the origins of a pool share the path", v, origins[0])
+		}
+		origins = append(origins, upstream)
+	}
+	r.upstream = origins[0]
+
+	config := balancer.Config{
+		Policy:   r.Balance,
+		MaxFails: r.MaxFails,
+		Retries:  r.Retries,
+	}
+	var err error
+	if config.FailTimeout, err = parseDuration(r.FailTimeout); err != nil {
+		return err
+	}
+	if r.HealthCheck != nil {
+		config.HealthPath = r.HealthCheck.Path
+		if config.HealthInterval, err = parseDuration(r.HealthCheck.Interval); err != nil {
+			return err
+		}
+		if config.HealthTimeout, err = parseDuration(r.HealthCheck.Timeout); err != nil {
+			return err
+		}
+	}
+	if r.pool, err = balancer.NewPool(origins, config); err != nil {
+		return err
+	}
+
+	if r.Prefix == "" {
+		r.Prefix = "/"
+	}
+	r.Host = strings.ToLower(r.Host)
+
+	r.policy = &roundtripper.CachePolicy{NoCache: r.NoCache}
+	if r.StatusTTL != "" {
+		r.policy.StatusTTL = roundtripper.StatusTTL{}
+		if err := r.policy.StatusTTL.Set(r.StatusTTL); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Route) matches(host, path string) bool {
+	return (r.Host == "" || r.Host == host) && strings.HasPrefix(path, r.Prefix)
+}
+
+// Rewrite returns the request directed to the upstream of the route. The
+// client is recorded in the X-Forwarded-Host and X-Forwarded-Proto headers.
+// The URL carries the first origin of the pool, so that the cache key doesn't
+// depend on the origin picked by the balancer.
+func (r *Route) Rewrite(req *http.Request) *http.Request {
+	ctx := roundtripper.WithCachePolicy(req.Context(), r.policy)
+	outreq := req.WithContext(balancer.WithPool(ctx, r.pool))
+	outreq.Header = make(http.Header, len(req.Header))
+	for k, vv := range req.Header {
+		outreq.Header[k] = vv
+	}
+
+	u := *req.URL
+	u.Scheme = r.upstream.Scheme
+	u.Host = r.upstream.Host
+	u.Path = joinPath(r.upstream.Path, req.URL.Path)
+	u.RawPath = ""
+	outreq.URL = &u
+
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+	outreq.Header.Set("X-Forwarded-Host", req.Host)
+	outreq.Header.Set("X-Forwarded-Proto", proto)
+
+	if !r.PreserveHost {
+		// the Host header is taken from the URL of the picked origin
+		outreq.Host = ""
+	}
+	return outreq
+}
+
+func parseDuration(v string) (time.Duration, error) {
+	if v == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("duration %q is bad (%v)", v, err)
+	}
+	return d, nil
+}
+
+func joinPath(a, b string) string {
+	switch {
+	case a == "":
+		return b
+	case strings.HasSuffix(a, "/") && strings.HasPrefix(b, "/"):
+		return a + b[1:]
+	case !strings.HasSuffix(a, "/") && !strings.HasPrefix(b, "/"):
+		return a + "/" + b
+	}
+	return a + b
+}
+
+// Table is an ordered set of routes.
+type Table []*Route
+
+// Load reads the routes file.
+func Load(path string) (Table, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var table Table
+	if err := json.NewDecoder(f).Decode(&table); err != nil {
+		return nil, fmt.Errorf("could not decode routes file %s (%v)", path, err)
+	}
+
+	if err := table.Init(); err != nil {
+		return nil, err
+	}
+	return table, nil
+}
+
+// Init validates the routes, it has to be called before Match.
+func (t Table) Init() error {
+	for i, r := range t {
+		if err := r.init(); err != nil {
+			return fmt.Errorf("route %d is bad (%v)", i, err)
+		}
+	}
+	return nil
+}
+
+// Origins returns the origins of all routes.
+func (t Table) Origins() []*url.URL {
+	var origins []*url.URL
+	for _, r := range t {
+		for _, o := range r.pool.Origins() {
+			origins = append(origins, o.URL)
+		}
+	}
+	return origins
+}
+
+// StartHealthChecks starts the health checks of the routes, they stop once
+// the stop channel is closed.
+func (t Table) StartHealthChecks(transport http.RoundTripper, logger func(v ...interface{}), stop <-chan struct{}) {
+	for _, r := range t {
+		r.pool.StartHealthCheck(transport, logger, stop)
+	}
+}
+
+// Absolute returns the request with the absolute URL of its target if it's a
+// forward proxy request over HTTP/2. The HTTP/2 server takes the URL from the
+// :path pseudo header only, so the target is rebuilt from the authority in the
+// Host field. Requests which match a route are left to the reverse proxy, and
+// the scheme follows the connection to the proxy, :scheme isn't passed on.
+func (t Table) Absolute(req *http.Request) *http.Request {
+	if req.ProtoMajor != 2 || req.URL.IsAbs() || req.Host == "" {
+		return req
+	}
+	if req.Method == http.MethodConnect && req.Header.Get(":protocol") == "" {
+		return req
+	}
+	if _, ok := t.Match(req); ok {
+		return req
+	}
+
+	outreq := req.WithContext(req.Context())
+	u := *req.URL
+	u.Scheme = "http"
+	if req.TLS != nil {
+		u.Scheme = "https"
+	}
+	u.Host = req.Host
+	outreq.URL = &u
+	return outreq
+}
+
+// Match returns the route of the request, the route with the longest
+// matching prefix wins.
+func (t Table) Match(req *http.Request) (*Route, bool) {
+	host := strings.ToLower(req.Host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	var match *Route
+	for _, r := range t {
+		if !r.matches(host, req.URL.Path) {
+			continue
+		}
+		// a route of the host has precedence over a route of all hosts
+		if match == nil || len(r.Prefix) > len(match.Prefix) || len(r.Prefix) == len(match.Prefix) && r.Host != "" && match.Host == "" {
+			match = r
+		}
+	}
+	return match, match != nil
+}
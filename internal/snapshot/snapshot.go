@@ -0,0 +1,242 @@
+package snapshot
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/donutloop/httpcache/internal/cache"
+	"github.com/donutloop/httpcache/internal/size"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Version is the version of the archive format.
+const Version = 1
+
+// ErrTooLarge is returned if the decompressed archive can't fit into the cache.
+var ErrTooLarge = errors.New("archive is too large")
+
+// An archive is a gzipped stream of JSON lines, the header is followed by the
+// entries from the least to the most recently used one.
+
+// Header is the first line of an archive.
+type Header struct {
+	Version int       `json:"version"`
+	Created time.Time `json:"created"`
+	Entries int       `json:"entries"`
+}
+
+// Entry is a cached response with its key and access time.
+type Entry struct {
+	Key           string      `json:"key"`
+	Method        string      `json:"method,omitempty"`
+	URL           string      `json:"url"`
+	Proto         string      `json:"proto"`
+	Status        int         `json:"status"`
+	Header        http.Header `json:"header"`
+	ContentLength int64       `json:"content_length"`
+	Body          []byte      `json:"body,omitempty"`
+	Encoding      string      `json:"encoding,omitempty"`
+	SliceSize     int64       `json:"slice_size,omitempty"`
+	Expires       time.Time   `json:"expires"`
+	Accessed      time.Time   `json:"accessed"`
+}
+
+// Report sums up an import, evicted entries didn't fit into the cache and
+// the failures name the entries which were skipped.
+type Report struct {
+	Imported int      `json:"imported"`
+	Evicted  int      `json:"evicted"`
+	Failed   int      `json:"failed"`
+	Failures []string `json:"failures,omitempty"`
+	Error    string   `json:"error,omitempty"`
+}
+
+// Export writes the entries of the cache to the archive and returns their
+// number.
+func Export(w io.Writer, c *cache.LRUCache) (int, error) {
+	items := c.Items()
+
+	zw := gzip.NewWriter(w)
+	bw := bufio.NewWriter(zw)
+	encoder := json.NewEncoder(bw)
+
+	if err := encoder.Encode(&Header{Version: Version, Created: time.Now(), Entries: len(items)}); err != nil {
+		return 0, err
+	}
+	for i, item := range items {
+		if err := encoder.Encode(entry(item)); err != nil {
+			return i, err
+		}
+	}
+
+	if err := bw.Flush(); err != nil {
+		return len(items), err
+	}
+	return len(items), zw.Close()
+}
+
+func entry(item cache.Item) *Entry {
+	e := &Entry{
+		Key:       item.Key,
+		Method:    item.Value.Method,
+		URL:       item.Value.URL,
+		Body:      item.Value.Body,
+		Encoding:  item.Value.Encoding,
+		SliceSize: item.Value.SliceSize,
+		Expires:   item.Value.Expires,
+		Accessed:  item.Accessed,
+	}
+	if resp := item.Value.Resp; resp != nil {
+		e.Proto = resp.Proto
+		e.Status = resp.StatusCode
+		e.Header = resp.Header
+		e.ContentLength = resp.ContentLength
+	}
+	return e
+}
+
+// Import restores the entries of the archive into the cache. Bad entries are
+// skipped and listed in the report, the error is set if the archive can't be
+// read to its end, the entries before were imported nevertheless.
+// The decompressed archive is limited to twice the capacity of the cache,
+// the bodies are base64 encoded, and entries with larger bodies than the
+// capacity are skipped.
+func Import(r io.Reader, c *cache.LRUCache) (*Report, error) {
+	report := &Report{}
+
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return report, fmt.Errorf("archive is bad (%w)", err)
+	}
+	decoder := json.NewDecoder(&limitedReader{r: zr, n: 2*c.Capacity() + 1*size.MB})
+
+	header := &Header{}
+	if err := decoder.Decode(header); err != nil {
+		return report, fmt.Errorf("archive header is bad (%w)", err)
+	}
+	if header.Version != Version {
+		return report, fmt.Errorf("archive version %d is not supported", header.Version)
+	}
+
+	// entries of the archive which are evicted again by later ones, because
+	// the cache is smaller than the one of the archive, count as evicted
+	imported := make(map[string]bool)
+	n := 0
+	for {
+		e := &Entry{}
+		err := decoder.Decode(e)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return report, fmt.Errorf("archive is bad after %d entries (%w)", n, err)
+		}
+		n++
+
+		if int64(len(e.Body)) > c.Capacity() {
+			report.Failed++
+			report.Failures = append(report.Failures, fmt.Sprintf("entry %d (%s) is larger than the cache", n, e.Key))
+			continue
+		}
+
+		item, err := e.item()
+		if err != nil {
+			report.Failed++
+			report.Failures = append(report.Failures, fmt.Sprintf("entry %d (%s) is bad (%v)", n, e.Key, err))
+			continue
+		}
+		if !imported[item.Key] {
+			imported[item.Key] = true
+			report.Imported++
+		}
+		for _, key := range c.Restore(item) {
+			if imported[key] {
+				delete(imported, key)
+				report.Imported--
+				report.Evicted++
+			}
+		}
+	}
+
+	if n != header.Entries {
+		return report, fmt.Errorf("archive is truncated, got=%d entries, want=%d", n, header.Entries)
+	}
+	return report, nil
+}
+
+// limitedReader reads at most n bytes, unlike io.LimitReader it fails
+// with ErrTooLarge afterwards.
+type limitedReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.n <= 0 {
+		return 0, ErrTooLarge
+	}
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	return n, err
+}
+
+// item validates the entry and returns it as cache item.
+func (e *Entry) item() (cache.Item, error) {
+	if e.Key == "" {
+		return cache.Item{}, errors.New("key is missing")
+	}
+	u, err := url.Parse(e.URL)
+	if err != nil || !u.IsAbs() {
+		return cache.Item{}, fmt.Errorf("url %q is not absolute", e.URL)
+	}
+	if e.Status < 100 || e.Status > 599 {
+		return cache.Item{}, fmt.Errorf("status %d is bad", e.Status)
+	}
+	major, minor, ok := http.ParseHTTPVersion(e.Proto)
+	if !ok {
+		return cache.Item{}, fmt.Errorf("proto %q is bad", e.Proto)
+	}
+	switch e.Encoding {
+	case "", "gzip":
+	default:
+		return cache.Item{}, fmt.Errorf("encoding %q is not supported", e.Encoding)
+	}
+	if e.SliceSize < 0 {
+		return cache.Item{}, fmt.Errorf("slice size %d is bad", e.SliceSize)
+	}
+
+	header := e.Header
+	if header == nil {
+		header = make(http.Header)
+	}
+	return cache.Item{
+		Key: e.Key,
+		Value: cache.CachedResponse{
+			Resp: &http.Response{
+				Status:        fmt.Sprintf("%d %s", e.Status, http.StatusText(e.Status)),
+				StatusCode:    e.Status,
+				Proto:         e.Proto,
+				ProtoMajor:    major,
+				ProtoMinor:    minor,
+				Header:        header,
+				ContentLength: e.ContentLength,
+				Body:          http.NoBody,
+			},
+			Body:      e.Body,
+			URL:       e.URL,
+			Method:    e.Method,
+			Encoding:  e.Encoding,
+			SliceSize: e.SliceSize,
+			Expires:   e.Expires,
+		},
+		Accessed: e.Accessed,
+	}, nil
+}
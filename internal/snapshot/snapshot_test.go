@@ -0,0 +1,178 @@
+package snapshot
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"github.com/donutloop/httpcache/internal/cache"
+	"github.com/donutloop/httpcache/internal/size"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func cachedResponse(url, body string) *cache.CachedResponse {
+	return &cache.CachedResponse{
+		Resp: &http.Response{
+			Status:     "200 OK",
+			StatusCode: http.StatusOK,
+			Proto:      "HTTP/1.1",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header:     http.Header{"Content-Type": {"text/plain"}},
+			Body:       http.NoBody,
+		},
+		Body:    []byte(body),
+		URL:     url,
+		Method:  http.MethodGet,
+		Expires: time.Now().Add(time.Hour).Round(0),
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	c := cache.NewLRUCache(1*size.MB, 0)
+	c.Set("a", cachedResponse("http://example.com/a", "a"))
+	c.Set("b", cachedResponse("http://example.com/b", "b"))
+	c.Get("a")
+
+	var archive bytes.Buffer
+	n, err := Export(&archive, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Fatalf("entries are bad, got=%d", n)
+	}
+
+	c2 := cache.NewLRUCache(1*size.MB, 0)
+	report, err := Import(&archive, c2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Imported != 2 || report.Failed != 0 {
+		t.Fatalf("report is bad, got=%#v", report)
+	}
+
+	items, want := c2.Items(), c.Items()
+	if len(items) != 2 || items[0].Key != "b" || items[1].Key != "a" {
+		t.Fatalf("order is bad, got=%v", items)
+	}
+	for i := range items {
+		if !items[i].Accessed.Equal(want[i].Accessed) {
+			t.Fatalf("access time is bad, got=%v, want=%v", items[i].Accessed, want[i].Accessed)
+		}
+	}
+
+	v, ok := c2.Get("a")
+	if !ok {
+		t.Fatal("entry is missing")
+	}
+	resp := v.Response(&http.Request{Method: http.MethodGet})
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/plain" || string(v.Body) != "a" || v.Method != http.MethodGet {
+		t.Fatalf("entry is bad, got=%#v", v)
+	}
+}
+
+func TestImport_Evicted(t *testing.T) {
+	c := cache.NewLRUCache(1*size.MB, 0)
+	for _, key := range []string{"a", "b", "c"} {
+		c.Set(key, cachedResponse("http://example.com/"+key, strings.Repeat(key, 100)))
+	}
+
+	var archive bytes.Buffer
+	if _, err := Export(&archive, c); err != nil {
+		t.Fatal(err)
+	}
+
+	// the cache holds two of the entries, the oldest one is evicted again
+	c2 := cache.NewLRUCache(250, 0)
+	report, err := Import(&archive, c2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Imported != 2 || report.Evicted != 1 || report.Failed != 0 {
+		t.Fatalf("report is bad, got=%#v", report)
+	}
+	if _, ok := c2.Get("a"); ok {
+		t.Fatal("oldest entry is not evicted")
+	}
+}
+
+func TestImport_TooLarge(t *testing.T) {
+	archive := func(body int64) *bytes.Buffer {
+		var b bytes.Buffer
+		zw := gzip.NewWriter(&b)
+		zw.Write([]byte(`{"version":1,"entries":2}` + "\n"))
+		zw.Write([]byte(`{"key":"a","url":"http://example.com/a","proto":"HTTP/1.1","status":200,"body":"`))
+		chunk := bytes.Repeat([]byte("A"), int(size.KB))
+		for i := int64(0); i < body/size.KB; i++ {
+			zw.Write(chunk)
+		}
+		zw.Write([]byte(`"}` + "\n"))
+		zw.Write([]byte(`{"key":"b","url":"http://example.com/b","proto":"HTTP/1.1","status":200}`))
+		zw.Close()
+		return &b
+	}
+
+	c := cache.NewLRUCache(1*size.KB, 0)
+
+	// the body of the first entry is larger than the cache
+	report, err := Import(archive(4*size.KB), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Imported != 1 || report.Failed != 1 || !strings.Contains(report.Failures[0], "entry 1 (a)") {
+		t.Fatalf("report is bad, got=%#v", report)
+	}
+
+	// a few KB of gzip which decompress to 10MB
+	b := archive(10 * size.MB)
+	if int64(b.Len()) > 64*size.KB {
+		t.Fatalf("archive size is bad, got=%d", b.Len())
+	}
+	if _, err := Import(b, c); !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("error is bad (%v)", err)
+	}
+}
+
+func TestImport_Bad(t *testing.T) {
+	archive := func(lines ...string) *bytes.Buffer {
+		var b bytes.Buffer
+		zw := gzip.NewWriter(&b)
+		zw.Write([]byte(strings.Join(lines, "\n")))
+		zw.Close()
+		return &b
+	}
+
+	c := cache.NewLRUCache(1*size.MB, 0)
+
+	if _, err := Import(strings.NewReader("plain"), c); err == nil {
+		t.Fatal("archive which isn't gzipped is imported")
+	}
+
+	if _, err := Import(archive(`{"version":2}`), c); err == nil || !strings.Contains(err.Error(), "version") {
+		t.Fatalf("error is bad (%v)", err)
+	}
+
+	report, err := Import(archive(
+		`{"version":1,"entries":3}`,
+		`{"key":"a","url":"http://example.com/a","proto":"HTTP/1.1","status":200}`,
+		`{"key":"b","url":"/relative","proto":"HTTP/1.1","status":200}`,
+		`{"key":"c","url":"http://example.com/c","proto":"HTTP/1.1","status":200}`,
+	), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Imported != 2 || report.Failed != 1 || !strings.Contains(report.Failures[0], "entry 2 (b)") {
+		t.Fatalf("report is bad, got=%#v", report)
+	}
+
+	report, err = Import(archive(
+		`{"version":1,"entries":2}`,
+		`{"key":"d","url":"http://example.com/d","proto":"HTTP/1.1","status":200}`,
+	), c)
+	if err == nil || !strings.Contains(err.Error(), "truncated") || report.Imported != 1 {
+		t.Fatalf("truncated archive is bad, got=(%#v, %v)", report, err)
+	}
+}
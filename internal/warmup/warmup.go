@@ -0,0 +1,214 @@
+package warmup
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Result is the outcome of fetching a single URL.
+type Result struct {
+	URL      string        `json:"url"`
+	Status   int           `json:"status,omitempty"`
+	Error    string        `json:"error,omitempty"`
+	Duration time.Duration `json:"duration"`
+}
+
+// Failed reports whether the URL couldn't be fetched or the origin answered
+// with an error status.
+func (r *Result) Failed() bool {
+	return r.Error != "" || r.Status >= 400
+}
+
+func (r *Result) reason() string {
+	if r.Error != "" {
+		return r.Error
+	}
+	return http.StatusText(r.Status)
+}
+
+// Report sums up a warm-up.
+type Report struct {
+	Total     int           `json:"total"`
+	Succeeded int           `json:"succeeded"`
+	Failed    int           `json:"failed"`
+	Failures  []*Result     `json:"failures,omitempty"`
+	Duration  time.Duration `json:"duration"`
+}
+
+// Warmer fetches lists of URLs through the cache, so that they're hot before
+// the clients request them.
+type Warmer struct {
+	// Transport is the cache transport the URLs are fetched with.
+	Transport http.RoundTripper
+
+	// Concurrency limits the URLs which are fetched at the same time.
+	Concurrency int
+
+	// Header is sent with each request. The request headers are part of the
+	// cache key, so the warmed entries are hit by the clients which send the
+	// same headers, e.g. User-Agent and Accept-Encoding. Optional.
+	Header http.Header
+
+	Logger func(v ...interface{})
+}
+
+// Warm fetches the URLs, progress is called with each result as it comes in
+// (optional). It stops early if the context is canceled.
+func (w *Warmer) Warm(ctx context.Context, urls []string, progress func(done int, result *Result)) *Report {
+	start := time.Now()
+	concurrency := w.Concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	report := &Report{Total: len(urls)}
+	results := make(chan *Result)
+	jobs := make(chan string)
+
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for u := range jobs {
+				results <- w.fetch(ctx, u)
+			}
+		}()
+	}
+
+	go func() {
+		defer close(jobs)
+		for _, u := range urls {
+			select {
+			case jobs <- u:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	done := 0
+	for result := range results {
+		done++
+		if result.Failed() {
+			w.Logger(fmt.Sprintf("warm-up of %s failed (%s) [%d/%d]", result.URL, result.reason(), done, report.Total))
+			report.Failed++
+			report.Failures = append(report.Failures, result)
+		} else {
+			report.Succeeded++
+		}
+		if progress != nil {
+			progress(done, result)
+		}
+	}
+
+	report.Duration = time.Since(start)
+	w.Logger(fmt.Sprintf("warm-up of %d urls done: %d succeeded, %d failed [%s]", report.Total, report.Succeeded, report.Failed, report.Duration))
+	return report
+}
+
+func (w *Warmer) fetch(ctx context.Context, u string) *Result {
+	start := time.Now()
+	result := &Result{URL: u}
+
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	for k, vv := range w.Header {
+		req.Header[k] = vv
+	}
+
+	resp, err := w.Transport.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		result.Error = err.Error()
+		result.Duration = time.Since(start)
+		return result
+	}
+	// the body is read to the end, so that streamed responses are cached as well
+	_, err = io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		result.Error = err.Error()
+	}
+	result.Status = resp.StatusCode
+	result.Duration = time.Since(start)
+	return result
+}
+
+// Headers is a set of request headers given as "Name: value" flags.
+type Headers http.Header
+
+func (h Headers) String() string {
+	lines := make([]string, 0, len(h))
+	for k, vv := range h {
+		for _, v := range vv {
+			lines = append(lines, k+": "+v)
+		}
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, ",")
+}
+
+func (h Headers) Set(value string) error {
+	kv := strings.SplitN(value, ":", 2)
+	if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+		return errors.New("header is not of the form Name: value")
+	}
+	http.Header(h).Add(strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1]))
+	return nil
+}
+
+// ReadURLs reads a list of absolute http and https URLs, one per line. Empty
+// lines and lines starting with # are skipped.
+func ReadURLs(r io.Reader) ([]string, error) {
+	var urls []string
+	scanner := bufio.NewScanner(r)
+	n := 0
+	for scanner.Scan() {
+		n++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		u, err := url.Parse(line)
+		if err != nil {
+			return nil, fmt.Errorf("url in line %d is bad (%v)", n, err)
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("url in line %d is not an absolute http url", n)
+		}
+		urls = append(urls, line)
+	}
+	return urls, scanner.Err()
+}
+
+// ReadFile reads the URLs of the file, "-" reads them from stdin.
+func ReadFile(file string) ([]string, error) {
+	if file == "-" {
+		return ReadURLs(os.Stdin)
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadURLs(f)
+}
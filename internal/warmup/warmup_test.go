@@ -0,0 +1,75 @@
+package warmup
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestReadURLs(t *testing.T) {
+	urls, err := ReadURLs(strings.NewReader("# artifacts\nhttp://example.com/a\n\n  https://example.com/b  \n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(urls) != 2 || urls[1] != "https://example.com/b" {
+		t.Fatalf("urls are bad, got=%v", urls)
+	}
+
+	if _, err := ReadURLs(strings.NewReader("http://example.com/a\n/relative\n")); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Fatalf("error is bad (%v)", err)
+	}
+}
+
+func TestWarmer_Warm(t *testing.T) {
+	var active, maxActive int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&active, 1)
+		defer atomic.AddInt32(&active, -1)
+		for {
+			m := atomic.LoadInt32(&maxActive)
+			if n <= m || atomic.CompareAndSwapInt32(&maxActive, m, n) {
+				break
+			}
+		}
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte("artifact"))
+	}))
+	defer origin.Close()
+
+	warmer := &Warmer{Transport: http.DefaultTransport, Concurrency: 2, Logger: t.Log}
+
+	urls := []string{origin.URL + "/a", origin.URL + "/b", origin.URL + "/missing", origin.URL + "/c", "http://127.0.0.1:0/"}
+	var progress int
+	report := warmer.Warm(context.Background(), urls, func(done int, result *Result) {
+		progress = done
+	})
+
+	if report.Total != 5 || report.Succeeded != 3 || report.Failed != 2 || progress != 5 {
+		t.Fatalf("report is bad, got=%#v", report)
+	}
+	if maxActive > 2 {
+		t.Fatalf("concurrency is bad, got=%d", maxActive)
+	}
+}
+
+func TestHeaders(t *testing.T) {
+	h := Headers{}
+	for _, v := range []string{"User-Agent: curl/8.0", "accept-encoding: gzip, br"} {
+		if err := h.Set(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := h.Set("gzip"); err == nil {
+		t.Fatal("header without name is accepted")
+	}
+
+	if h.String() != "Accept-Encoding: gzip, br,User-Agent: curl/8.0" {
+		t.Fatalf("headers are bad, got=%s", h.String())
+	}
+}
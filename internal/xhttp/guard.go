@@ -0,0 +1,182 @@
+package xhttp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"path"
+	"strings"
+	"syscall"
+)
+
+var DestinationIsBlocked = errors.New("destination address is blocked")
+
+// blocked are the internal ranges next to the loopback, private, link-local,
+// multicast and unspecified addresses known to the net package.
+var blocked = []*net.IPNet{
+	mustParseCIDR("0.0.0.0/8"),
+	mustParseCIDR("100.64.0.0/10"), // carrier-grade NAT
+	mustParseCIDR("192.0.0.0/24"),
+	mustParseCIDR("198.18.0.0/15"), // benchmarking
+	mustParseCIDR("240.0.0.0/4"),
+	mustParseCIDR("64:ff9b::/96"), // NAT64, embeds IPv4 addresses
+}
+
+// Guard blocks connections to loopback, link-local (e.g. the metadata
+// service at 169.254.169.254), private and other internal addresses. The
+// address is checked right before the connection is made, after the host is
+// resolved, so that DNS rebinding can't get around it.
+type Guard struct {
+	// Allow lists the exceptions.
+	Allow Allowlist
+}
+
+// Allowlist is a list of CIDRs, IPs and host globs with optional ports, it
+// implements flag.Value with comma separated entries.
+type Allowlist struct {
+	entries []string
+	cidrs   []*net.IPNet
+	hosts   []string
+}
+
+func (a *Allowlist) String() string {
+	return strings.Join(a.entries, ",")
+}
+
+func (a *Allowlist) Set(value string) error {
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.ToLower(strings.TrimSpace(entry)); entry == "" {
+			continue
+		}
+		if err := a.add(entry); err != nil {
+			return err
+		}
+		a.entries = append(a.entries, entry)
+	}
+	return nil
+}
+
+func (a *Allowlist) add(entry string) error {
+	if _, cidr, err := net.ParseCIDR(entry); err == nil {
+		a.cidrs = append(a.cidrs, cidr)
+		return nil
+	}
+	if ip := net.ParseIP(entry); ip != nil {
+		a.cidrs = append(a.cidrs, singleIP(ip))
+		return nil
+	}
+	pattern := entry
+	if host, _, err := net.SplitHostPort(entry); err == nil {
+		pattern = host
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("allowlist entry %q is bad (%v)", entry, err)
+	}
+	a.hosts = append(a.hosts, entry)
+	return nil
+}
+
+// allowsHost reports whether the host:port is allowed by a host entry.
+func (a *Allowlist) allowsHost(addr string) bool {
+	host, port, err := net.SplitHostPort(strings.ToLower(addr))
+	if err != nil {
+		return false
+	}
+	for _, entry := range a.hosts {
+		pattern, entryPort, err := net.SplitHostPort(entry)
+		if err != nil {
+			pattern, entryPort = entry, ""
+		}
+		if entryPort != "" && entryPort != port {
+			continue
+		}
+		if ok, _ := path.Match(pattern, host); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *Allowlist) allowsIP(ip net.IP) bool {
+	for _, cidr := range a.cidrs {
+		if cidr.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check returns DestinationIsBlocked if the ip is internal and not allowed.
+func (g *Guard) Check(ip net.IP) error {
+	if g.Allow.allowsIP(ip) || !internal(ip) {
+		return nil
+	}
+	return fmt.Errorf("%w: %s", DestinationIsBlocked, ip)
+}
+
+// CheckAddr is Check of the ip which the host:port resolved to, hosts of the
+// allowlist are passed.
+func (g *Guard) CheckAddr(addr string, ip net.IP) error {
+	if g.Allow.allowsHost(addr) {
+		return nil
+	}
+	return g.Check(ip)
+}
+
+// control is the net.Dialer hook which checks the resolved address.
+func (g *Guard) control(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("%w: %s is no ip", DestinationIsBlocked, host)
+	}
+	return g.Check(ip)
+}
+
+// dial returns the dial func of the dialer which only connects to allowed
+// addresses, hosts of the allowlist are connected to without checks.
+func (g *Guard) dial(dialer *net.Dialer, resolve Resolve) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	guarded := *dialer
+	guarded.Control = g.control
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if g.Allow.allowsHost(addr) {
+			return dialer.DialContext(ctx, network, resolve.Address(addr))
+		}
+		return guarded.DialContext(ctx, network, resolve.Address(addr))
+	}
+}
+
+func internal(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return true
+	}
+	if ip4 := ip.To4(); ip4 != nil && ip4.Equal(net.IPv4bcast) {
+		return true
+	}
+	for _, cidr := range blocked {
+		if cidr.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func singleIP(ip net.IP) *net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(8*net.IPv4len, 8*net.IPv4len)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(8*net.IPv6len, 8*net.IPv6len)}
+}
+
+func mustParseCIDR(v string) *net.IPNet {
+	_, cidr, err := net.ParseCIDR(v)
+	if err != nil {
+		panic(err)
+	}
+	return cidr
+}
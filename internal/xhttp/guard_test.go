@@ -0,0 +1,100 @@
+package xhttp
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGuard_Check(t *testing.T) {
+	guard := &Guard{}
+	if err := guard.Allow.Set("10.1.0.0/16, 192.168.1.10"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]bool{
+		"127.0.0.1":       false,
+		"::1":             false,
+		"169.254.169.254": false,
+		"fe80::1":         false,
+		"10.0.0.1":        false,
+		"172.16.0.1":      false,
+		"192.168.1.1":     false,
+		"100.64.0.1":      false,
+		"0.0.0.0":         false,
+		"::ffff:10.0.0.1": false,
+		"fd00::1":         false,
+		"10.1.2.3":        true,
+		"192.168.1.10":    true,
+		"93.184.216.34":   true,
+		"2606:4700::1111": true,
+	}
+	for v, allowed := range tests {
+		err := guard.Check(net.ParseIP(v))
+		if (err == nil) != allowed {
+			t.Errorf("check of %s is bad, got=%v", v, err)
+		}
+	}
+}
+
+func TestGuard_CheckAddr(t *testing.T) {
+	guard := &Guard{}
+	if err := guard.Allow.Set("cache.internal:6379"); err != nil {
+		t.Fatal(err)
+	}
+
+	loopback := net.ParseIP("127.0.0.1")
+	if err := guard.CheckAddr("cache.internal:6379", loopback); err != nil {
+		t.Fatalf("check of allowed host is bad (%v)", err)
+	}
+	if err := guard.CheckAddr("cache.internal:6380", loopback); !errors.Is(err, DestinationIsBlocked) {
+		t.Fatalf("check of other port is bad (%v)", err)
+	}
+	if err := guard.CheckAddr("169.254.169.254:80", net.ParseIP("169.254.169.254")); !errors.Is(err, DestinationIsBlocked) {
+		t.Fatalf("check of metadata service is bad (%v)", err)
+	}
+}
+
+func TestGuard_Dial(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	_, port, err := net.SplitHostPort(server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the host resolves to loopback, like a rebound DNS name
+	resolve := Resolve{}
+	resolve.Set("rebind.example.com=127.0.0.1")
+	url := "http://rebind.example.com:" + port + "/"
+
+	transport, _, err := NewTransport(TransportConfig{Resolve: resolve, Guard: &Guard{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = (&http.Client{Transport: transport}).Get(url)
+	if !errors.Is(err, DestinationIsBlocked) {
+		t.Fatalf("error is bad (%v)", err)
+	}
+
+	guard := &Guard{}
+	guard.Allow.Set("rebind.example.com:" + port)
+	transport, _, err = NewTransport(TransportConfig{Resolve: resolve, Guard: guard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := (&http.Client{Transport: transport}).Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status code is bad (%v)", resp.StatusCode)
+	}
+}
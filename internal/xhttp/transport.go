@@ -0,0 +1,180 @@
+package xhttp
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// TransportConfig configures the transport to the upstream origins.
+type TransportConfig struct {
+	// MaxIdleConns limits the idle connections across all hosts,
+	// MaxIdleConnsPerHost those of a single host and MaxConnsPerHost all
+	// connections of a single host, zero means no limit.
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	MaxConnsPerHost     int
+
+	DialTimeout           time.Duration
+	TLSHandshakeTimeout   time.Duration
+	ResponseHeaderTimeout time.Duration
+	IdleConnTimeout       time.Duration
+
+	// KeepAlive is the interval of TCP keep-alive probes, negative values
+	// disable them. DisableKeepAlives uses a connection per request.
+	KeepAlive         time.Duration
+	DisableKeepAlives bool
+
+	// HTTP2 negotiates HTTP/2 with TLS origins.
+	HTTP2 bool
+
+	// RootCAs are PEM files of the CAs which verify the origins, empty
+	// uses the CAs of the system.
+	RootCAs []string
+
+	// ClientCert and ClientKey are the PEM files of the certificate which
+	// is presented to origins requiring mutual TLS (optional).
+	ClientCert string
+	ClientKey  string
+
+	// Resolve overrides the addresses of hosts.
+	Resolve Resolve
+
+	// DNSServer is the address of the DNS server which resolves the hosts,
+	// empty uses the resolver of the system.
+	DNSServer string
+
+	// Guard blocks connections to internal addresses (optional).
+	Guard *Guard
+
+	// Proxy selects the parent proxy of a request (optional).
+	Proxy func(*http.Request) (*url.URL, error)
+}
+
+// NewTransport creates the transport of the configuration, the returned
+// dial func connects with the same dialer and resolver.
+func NewTransport(config TransportConfig) (*http.Transport, func(ctx context.Context, network, addr string) (net.Conn, error), error) {
+	tlsConfig := &tls.Config{}
+
+	if len(config.RootCAs) > 0 {
+		pool := x509.NewCertPool()
+		for _, file := range config.RootCAs {
+			pem, err := ioutil.ReadFile(file)
+			if err != nil {
+				return nil, nil, err
+			}
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, nil, fmt.Errorf("root ca file %s has no certificates", file)
+			}
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if config.ClientCert != "" || config.ClientKey != "" {
+		cert, err := tls.LoadX509KeyPair(config.ClientCert, config.ClientKey)
+		if err != nil {
+			return nil, nil, fmt.Errorf("client certificate is bad (%v)", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   config.DialTimeout,
+		KeepAlive: config.KeepAlive,
+		Resolver:  config.Resolver(),
+	}
+
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return dialer.DialContext(ctx, network, config.Resolve.Address(addr))
+	}
+	if config.Guard != nil {
+		dial = config.Guard.dial(dialer, config.Resolve)
+	}
+
+	transport := &http.Transport{
+		Proxy:                 config.Proxy,
+		DialContext:           dial,
+		TLSClientConfig:       tlsConfig,
+		MaxIdleConns:          config.MaxIdleConns,
+		MaxIdleConnsPerHost:   config.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       config.MaxConnsPerHost,
+		IdleConnTimeout:       config.IdleConnTimeout,
+		TLSHandshakeTimeout:   config.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: config.ResponseHeaderTimeout,
+		ExpectContinueTimeout: 1 * time.Second,
+		DisableKeepAlives:     config.DisableKeepAlives,
+		ForceAttemptHTTP2:     config.HTTP2,
+	}
+	if !config.HTTP2 {
+		// a non-nil map disables the automatic HTTP/2 upgrade
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	return transport, dial, nil
+}
+
+// Resolver returns the resolver of the DNS server, nil if the resolver of
+// the system is used.
+func (config TransportConfig) Resolver() *net.Resolver {
+	if config.DNSServer == "" {
+		return nil
+	}
+	server := config.DNSServer
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, server)
+		},
+	}
+}
+
+// Resolve maps hosts to the addresses they're connected to, like curl
+// --resolve. It implements flag.Value with host=address pairs, the address
+// may carry a port which then replaces the port of all connections.
+type Resolve map[string]string
+
+func (r Resolve) String() string {
+	pairs := make([]string, 0, len(r))
+	for host, addr := range r {
+		pairs = append(pairs, host+"="+addr)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (r Resolve) Set(value string) error {
+	kv := strings.SplitN(value, "=", 2)
+	if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" || strings.TrimSpace(kv[1]) == "" {
+		return errors.New("resolve override is not of the form host=address")
+	}
+	r[strings.ToLower(strings.TrimSpace(kv[0]))] = strings.TrimSpace(kv[1])
+	return nil
+}
+
+// Address returns the overridden address of host:port.
+func (r Resolve) Address(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	override, ok := r[strings.ToLower(host)]
+	if !ok {
+		return addr
+	}
+	if _, _, err := net.SplitHostPort(override); err == nil {
+		return override
+	}
+	return net.JoinHostPort(override, port)
+}
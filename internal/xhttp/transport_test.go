@@ -0,0 +1,101 @@
+package xhttp
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewTransport(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) == 0 {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	server.StartTLS()
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "transport")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the certificate of the test server is valid for example.com and
+	// signs itself, it serves as root ca and client certificate
+	cert := server.TLS.Certificates[0]
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	_, port, err := net.SplitHostPort(server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resolve := Resolve{}
+	if err := resolve.Set("example.com=127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+
+	transport, _, err := NewTransport(TransportConfig{
+		RootCAs:    []string{certFile},
+		ClientCert: certFile,
+		ClientKey:  keyFile,
+		Resolve:    resolve,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, "https://example.com:"+port+"/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status code is bad, got=%d", resp.StatusCode)
+	}
+}
+
+func TestResolve_Address(t *testing.T) {
+	resolve := Resolve{}
+	resolve.Set("api.example.com=10.0.0.1")
+	resolve.Set("www.example.com=10.0.0.2:8443")
+
+	tests := map[string]string{
+		"api.example.com:443": "10.0.0.1:443",
+		"API.example.com:80":  "10.0.0.1:80",
+		"www.example.com:443": "10.0.0.2:8443",
+		"example.com:443":     "example.com:443",
+	}
+	for addr, want := range tests {
+		if got := resolve.Address(addr); got != want {
+			t.Errorf("address of %s is bad, got=%s, want=%s", addr, got, want)
+		}
+	}
+}
@@ -1,15 +1,34 @@
 package tests
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crand "crypto/rand"
 	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
 	"fmt"
+	"github.com/donutloop/httpcache/internal/acl"
+	"github.com/donutloop/httpcache/internal/auth"
 	"github.com/donutloop/httpcache/internal/cache"
 	"github.com/donutloop/httpcache/internal/handler"
+	"github.com/donutloop/httpcache/internal/har"
 	"github.com/donutloop/httpcache/internal/middleware"
+	"github.com/donutloop/httpcache/internal/mitm"
+	"github.com/donutloop/httpcache/internal/roundtripper"
+	"github.com/donutloop/httpcache/internal/route"
 	"github.com/donutloop/httpcache/internal/size"
+	"github.com/donutloop/httpcache/internal/snapshot"
+	"github.com/donutloop/httpcache/internal/warmup"
 	"github.com/donutloop/httpcache/internal/xhttp"
+	"io"
+	"io/ioutil"
 	"log"
+	"math/big"
 	"math/rand"
 	"net"
 	"net/http"
@@ -17,6 +36,9 @@ import (
 	"net/http/httputil"
 	"net/url"
 	"os"
+	"os/exec"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
@@ -24,22 +46,32 @@ import (
 var client *http.Client
 var clientTls *http.Client
 var c *cache.LRUCache
+var proxyAddr string
+var adminServer *httptest.Server
+
+const adminToken = "admin-secret"
 
 func TestMain(m *testing.M) {
-	c = cache.NewLRUCache(100, 0)
+	c = cache.NewLRUCache(1*size.MB, 0)
 	stats := handler.NewStats(c, log.Println)
-	ping := handler.NewPing(log.Println)
 	proxy := handler.NewProxy(
 		c,
 		log.Println,
 		500*size.MB,
-		ping,
 		stats,
+		http.DefaultTransport,
 	)
+	{
+		// the test servers listen on random ports
+		proxy.TunnelPorts = nil
+	}
 
 	stack := middleware.NewPanic(proxy, log.Println)
 
+	adminServer = httptest.NewServer(handler.NewAdmin(handler.NewPing(log.Println), stats, handler.NewHealth(log.Println), adminToken, log.Println))
+
 	proxyServer := httptest.NewServer(stack)
+	proxyAddr = proxyServer.Listener.Addr().String()
 	proxyServerTLS := httptest.NewTLSServer(proxy)
 
 	transport := &http.Transport{
@@ -96,18 +128,9 @@ func TestMain(m *testing.M) {
 		Transport: testtransport,
 	}
 
-	resp, err := testclient.Get(fmt.Sprintf("%v/ping", proxyServerTLS.URL))
-	if err != nil {
-		log.Fatalln(fmt.Sprintf("tls proxy (%v)", err))
-	}
-
-	if resp.StatusCode != http.StatusOK {
-		log.Fatalln(fmt.Sprintf("status code is bad (%v)", resp.StatusCode))
-	}
-
-	resp, err = testclient.Get(fmt.Sprintf("%v/ping", proxyServer.URL))
+	resp, err := testclient.Get(fmt.Sprintf("%v/ping", adminServer.URL))
 	if err != nil {
-		log.Fatalln(fmt.Sprintf("proxy (%v)", err))
+		log.Fatalln(fmt.Sprintf("admin (%v)", err))
 	}
 
 	if resp.StatusCode != http.StatusOK {
@@ -158,6 +181,137 @@ func TestProxyHTTPSHandler(t *testing.T) {
 	}
 }
 
+// newInterceptor returns an interceptor of all hosts with a CA of its own.
+func newInterceptor(t *testing.T) *mitm.Interceptor {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "httpcache test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(crand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certs, err := mitm.NewCertStore(tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &mitm.Interceptor{Certs: certs}
+}
+
+func TestProxyHTTPSHandler_InterceptSpoofedHost(t *testing.T) {
+	victim := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("victim"))
+	}))
+	defer victim.Close()
+	attacker := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("attacker"))
+	}))
+	defer attacker.Close()
+
+	c1 := cache.NewLRUCache(1*size.MB, 0)
+	upstream := &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	proxy := handler.NewProxy(c1, log.Println, 500*size.MB, handler.NewStats(c1, log.Println), upstream)
+	{
+		proxy.TunnelPorts = nil
+		proxy.Interceptor = newInterceptor(t)
+	}
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+
+	get := func(rawURL, host string) string {
+		proxyClient := &http.Client{Transport: &http.Transport{
+			Proxy:           SetProxyURL(proxyServer.URL),
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}}
+		req, err := http.NewRequest(http.MethodGet, rawURL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Host = host
+		resp, err := proxyClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+
+	victimHost := victim.Listener.Addr().String()
+	if body := get(attacker.URL+"/a", victimHost); body != "attacker" {
+		t.Fatalf("response body is bad, got=%s", body)
+	}
+	if body := get(victim.URL+"/a", victimHost); body != "victim" {
+		t.Fatalf("response of spoofed host is served to the victim, got=%s", body)
+	}
+}
+
+func TestProxyHTTPSHandler_InterceptMiddleware(t *testing.T) {
+	origin := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("origin"))
+	}))
+	defer origin.Close()
+
+	c1 := cache.NewLRUCache(1*size.MB, 0)
+	upstream := &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	proxy := handler.NewProxy(c1, log.Println, 500*size.MB, handler.NewStats(c1, log.Println), upstream)
+	{
+		proxy.TunnelPorts = nil
+		proxy.Interceptor = newInterceptor(t)
+	}
+
+	list := &acl.List{Rules: []*acl.Rule{{Action: acl.Deny, Methods: []string{http.MethodPost}, Reason: "read only"}}}
+	if err := list.Init(); err != nil {
+		t.Fatal(err)
+	}
+	var next http.Handler = middleware.NewACL(proxy, list, log.Println)
+	next = middleware.NewProxyAuth(next, &auth.Authenticator{
+		Users: auth.Htpasswd{"alice": "{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ="},
+		Realm: "httpcache",
+	}, log.Println)
+	stack := middleware.NewPanic(next, log.Println)
+	proxy.Handler = stack
+
+	proxyServer := httptest.NewServer(stack)
+	defer proxyServer.Close()
+
+	// the CONNECT authenticates the tunnel, the decrypted requests pass the acl
+	proxyClient := &http.Client{Transport: &http.Transport{
+		Proxy:           SetProxyURL(strings.Replace(proxyServer.URL, "http://", "http://alice:secret@", 1)),
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+
+	resp, err := proxyClient.Get(origin.URL + "/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status code is bad (%v)", resp.StatusCode)
+	}
+
+	resp, err = proxyClient.Post(origin.URL+"/a", "text/plain", strings.NewReader("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden || resp.Header.Get(middleware.ReasonHeader) != "read only" {
+		t.Fatalf("response is bad, got=(%d, %s)", resp.StatusCode, resp.Header.Get(middleware.ReasonHeader))
+	}
+}
+
 func TestProxyHandler(t *testing.T) {
 	defer c.Reset()
 
@@ -217,13 +371,14 @@ func TestStatsHandler(t *testing.T) {
 		t.Fatalf("cache length is bad, got=%d", c.Length())
 	}
 
-	req, err = http.NewRequest(http.MethodGet, server.URL+"/stats", nil)
+	req, err = http.NewRequest(http.MethodGet, adminServer.URL+"/stats", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
+	req.Header.Set("Authorization", "Bearer "+adminToken)
 
 	t.Log(req.URL)
-	resp, err = client.Do(req)
+	resp, err = http.DefaultClient.Do(req)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -248,8 +403,323 @@ func TestStatsHandler(t *testing.T) {
 	t.Log(fmt.Sprintf("%#v", statsResponse))
 }
 
+func TestAdminHandler(t *testing.T) {
+	defer c.Reset()
+
+	testHandler := func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(r.URL.Path))
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(testHandler))
+
+	// the paths of the admin endpoints are proxied untouched
+	for _, path := range []string{"/ping", "/stats"} {
+		resp, err := client.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != path {
+			t.Fatalf("response body is bad, got=%s", b)
+		}
+	}
+
+	resp, err := http.Get(adminServer.URL + "/stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("status code is bad (%v)", resp.StatusCode)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, adminServer.URL+"/stats", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer wrong")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("status code is bad (%v)", resp.StatusCode)
+	}
+}
+
+func TestHealthHandler(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	health := handler.NewHealth(log.Println)
+	health.AddCheck("upstream probe", handler.ProbeURL(http.DefaultTransport, origin.URL))
+	admin := httptest.NewServer(handler.NewAdmin(handler.NewPing(log.Println), handler.NewStats(c, log.Println), health, adminToken, log.Println))
+
+	status := func(path string) int {
+		resp, err := http.Get(admin.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := status("/healthz"); code != http.StatusOK {
+		t.Fatalf("status code is bad (%v)", code)
+	}
+	if code := status("/readyz"); code != http.StatusOK {
+		t.Fatalf("status code is bad (%v)", code)
+	}
+
+	done := health.Pending("warm-up")
+	if code := status("/readyz"); code != http.StatusServiceUnavailable {
+		t.Fatalf("status code is bad (%v)", code)
+	}
+	done()
+
+	origin.Close()
+	if code := status("/readyz"); code != http.StatusServiceUnavailable {
+		t.Fatalf("status code is bad (%v)", code)
+	}
+
+	// a proxy which shuts down is live, but not ready
+	health = handler.NewHealth(log.Println)
+	admin = httptest.NewServer(handler.NewAdmin(handler.NewPing(log.Println), handler.NewStats(c, log.Println), health, adminToken, log.Println))
+	health.Shutdown()
+	if code := status("/readyz"); code != http.StatusServiceUnavailable {
+		t.Fatalf("status code is bad (%v)", code)
+	}
+	if code := status("/healthz"); code != http.StatusOK {
+		t.Fatalf("status code is bad (%v)", code)
+	}
+}
+
+func TestWarmupHandler(t *testing.T) {
+	var requests int
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte("artifact"))
+	}))
+	defer origin.Close()
+
+	c1 := cache.NewLRUCache(1*size.MB, 0)
+	stats := handler.NewStats(c1, log.Println)
+	proxy := handler.NewProxy(c1, log.Println, 500*size.MB, stats, http.DefaultTransport)
+	{
+		proxy.CacheTransport.StatusTTL = roundtripper.StatusTTL{"404": 0}
+	}
+
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+	proxyClient := &http.Client{Transport: &http.Transport{Proxy: SetProxyURL(proxyServer.URL)}}
+
+	// the headers of the go client, so that its requests hit the warmed entries
+	warmer := &warmup.Warmer{
+		Transport:   proxy.CacheTransport,
+		Concurrency: 2,
+		Header:      http.Header{"User-Agent": {"Go-http-client/1.1"}, "Accept-Encoding": {"gzip"}},
+		Logger:      log.Println,
+	}
+	admin := handler.NewAdmin(handler.NewPing(log.Println), stats, handler.NewHealth(log.Println), adminToken, log.Println)
+	admin.Handle("/warmup", handler.NewWarmup(warmer, log.Println))
+	adminServer := httptest.NewServer(admin)
+	defer adminServer.Close()
+
+	body := strings.Join([]string{origin.URL + "/a", origin.URL + "/b", origin.URL + "/missing"}, "\n")
+	req, err := http.NewRequest(http.MethodPost, adminServer.URL+"/warmup", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status code is bad (%v)", resp.StatusCode)
+	}
+
+	var lines []string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if len(lines) != 4 {
+		t.Fatalf("lines are bad, got=%v", lines)
+	}
+
+	report := &warmup.Report{}
+	if err := json.Unmarshal([]byte(lines[3]), report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Succeeded != 2 || report.Failed != 1 || report.Failures[0].Status != http.StatusNotFound {
+		t.Fatalf("report is bad, got=%#v", report)
+	}
+
+	if c1.Length() != 2 {
+		t.Fatalf("cache length is bad, got=%d", c1.Length())
+	}
+
+	resp, err = proxyClient.Get(origin.URL + "/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	artifact, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(artifact) != "artifact" || requests != 3 {
+		t.Fatalf("proxied request is not a hit, got=(%s, %d requests)", artifact, requests)
+	}
+}
+
+func TestSnapshotHandler_MaxSize(t *testing.T) {
+	c1 := cache.NewLRUCache(1*size.MB, 0)
+	c1.Set("a", &cache.CachedResponse{
+		Resp: &http.Response{StatusCode: http.StatusOK, Proto: "HTTP/1.1", Header: http.Header{}, Body: http.NoBody},
+		Body: []byte(generateData(1024)),
+		URL:  "http://example.com/a",
+	})
+	var archive bytes.Buffer
+	if _, err := snapshot.Export(&archive, c1); err != nil {
+		t.Fatal(err)
+	}
+
+	snapshotHandler := handler.NewSnapshot(c1, log.Println)
+	{
+		snapshotHandler.MaxSize = 64
+	}
+	server := httptest.NewServer(snapshotHandler)
+	defer server.Close()
+
+	resp, err := http.Post(server.URL, "application/gzip", &archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("status code is bad (%v)", resp.StatusCode)
+	}
+}
+
+func TestSnapshotHandler_GzipBomb(t *testing.T) {
+	// the archive is far smaller than MaxSize, but decompresses to 10MB
+	var archive bytes.Buffer
+	zw := gzip.NewWriter(&archive)
+	zw.Write([]byte(`{"version":1,"entries":1}` + "\n" + `{"key":"a","url":"http://example.com/a","proto":"HTTP/1.1","status":200,"body":"`))
+	chunk := bytes.Repeat([]byte("A"), int(size.KB))
+	for i := 0; i < 10*1024; i++ {
+		zw.Write(chunk)
+	}
+	zw.Write([]byte(`"}`))
+	zw.Close()
+
+	c1 := cache.NewLRUCache(1*size.MB, 0)
+	server := httptest.NewServer(handler.NewSnapshot(c1, log.Println))
+	defer server.Close()
+
+	resp, err := http.Post(server.URL, "application/gzip", &archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("status code is bad (%v)", resp.StatusCode)
+	}
+	if c1.Length() != 0 {
+		t.Fatalf("cache length is bad, got=%d", c1.Length())
+	}
+}
+
+func TestHARHandler(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"count": 10}`))
+	}))
+	defer origin.Close()
+
+	c1 := cache.NewLRUCache(1*size.MB, 0)
+	stats := handler.NewStats(c1, log.Println)
+	proxy := handler.NewProxy(c1, log.Println, 500*size.MB, stats, http.DefaultTransport)
+	recorder := har.NewRecorder(10, 1*size.KB)
+	{
+		proxy.LoggedTransport.Recorder = recorder
+	}
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+
+	admin := handler.NewAdmin(handler.NewPing(log.Println), stats, handler.NewHealth(log.Println), adminToken, log.Println)
+	admin.Handle("/har", handler.NewHAR(c1, recorder, log.Println))
+	adminServer := httptest.NewServer(admin)
+	defer adminServer.Close()
+
+	proxyClient := &http.Client{Transport: &http.Transport{Proxy: SetProxyURL(proxyServer.URL)}}
+	for i := 0; i < 2; i++ {
+		resp, err := proxyClient.Get(origin.URL + "/count")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+
+	for _, source := range []string{"recent", "cache"} {
+		req, err := http.NewRequest(http.MethodGet, adminServer.URL+"/har?source="+source, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+adminToken)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("status code is bad (%v)", resp.StatusCode)
+		}
+
+		archive := &har.HAR{}
+		err = json.NewDecoder(resp.Body).Decode(archive)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := 2
+		if source == "cache" {
+			want = 1
+		}
+		if len(archive.Log.Entries) != want {
+			t.Fatalf("%s entries are bad, got=%d", source, len(archive.Log.Entries))
+		}
+		if content := archive.Log.Entries[0].Response.Content; content.Text != `{"count": 10}` {
+			t.Fatalf("%s content is bad, got=%#v", source, content)
+		}
+	}
+}
+
 func TestProxyHandler_ResponseBodyContentLengthLimit(t *testing.T) {
-	c1 := cache.NewLRUCache(100, 1*time.Second)
+	c1 := cache.NewLRUCache(1*size.MB, 1*time.Second)
 	{
 		c1.OnEviction = func(key string) {
 			c1.Delete(key)
@@ -262,13 +732,12 @@ func TestProxyHandler_ResponseBodyContentLengthLimit(t *testing.T) {
 		logger := log.New(os.Stderr, "", log.LstdFlags)
 
 		stats := handler.NewStats(c, logger.Println)
-		ping := handler.NewPing(logger.Println)
 		proxy := handler.NewProxy(
 			c,
 			logger.Println,
 			cl,
-			ping,
 			stats,
+			http.DefaultTransport,
 		)
 
 		mux := http.NewServeMux()
@@ -340,7 +809,7 @@ func TestProxyHandler_ResponseBodyContentLengthLimit(t *testing.T) {
 }
 
 func TestProxyHandler_GC(t *testing.T) {
-	c1 := cache.NewLRUCache(100, 1*time.Second)
+	c1 := cache.NewLRUCache(1*size.MB, 1*time.Second)
 	{
 		c1.OnEviction = func(key string) {
 			c1.Delete(key)
@@ -350,13 +819,12 @@ func TestProxyHandler_GC(t *testing.T) {
 	go func() {
 		logger := log.New(os.Stderr, "", log.LstdFlags)
 		stats := handler.NewStats(c, logger.Println)
-		ping := handler.NewPing(logger.Println)
 		proxy := handler.NewProxy(
 			c,
 			logger.Println,
 			3*size.MB,
-			ping,
 			stats,
+			http.DefaultTransport,
 		)
 
 		mux := http.NewServeMux()
@@ -428,18 +896,17 @@ func TestProxyHandler_GC(t *testing.T) {
 
 func TestProxyHttpServer(t *testing.T) {
 
-	c1 := cache.NewLRUCache(100, 0)
+	c1 := cache.NewLRUCache(1*size.MB, 0)
 	go func() {
 		logger := log.New(os.Stderr, "", log.LstdFlags)
 
 		stats := handler.NewStats(c, logger.Println)
-		ping := handler.NewPing(logger.Println)
 		proxy := handler.NewProxy(
 			c1,
 			logger.Println,
 			5*size.MB,
-			ping,
 			stats,
+			http.DefaultTransport,
 		)
 		mux := http.NewServeMux()
 		mux.Handle("/", proxy)
@@ -556,3 +1023,531 @@ func generateData(n int) string {
 	}
 	return string(b)
 }
+
+func TestProxyHandler_ReverseProxy(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(r.URL.Path + " " + r.Header.Get("X-Forwarded-Host")))
+	}))
+
+	c1 := cache.NewLRUCache(1*size.MB, 0)
+	stats := handler.NewStats(c1, log.Println)
+	proxy := handler.NewProxy(
+		c1,
+		log.Println,
+		5*size.MB,
+		stats,
+		http.DefaultTransport,
+	)
+	{
+		proxy.Routes = route.Table{
+			{Host: "api.example.com", Prefix: "/v1/", Upstream: upstream.URL + "/api"},
+		}
+		if err := proxy.Routes.Init(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	server := httptest.NewServer(proxy)
+
+	for _, test := range []struct {
+		host   string
+		status int
+		body   string
+	}{
+		{host: "api.example.com", status: http.StatusOK, body: "/api/v1/items api.example.com"},
+		{host: "www.example.com", status: http.StatusNotFound, body: ""},
+	} {
+		req, err := http.NewRequest(http.MethodGet, server.URL+"/v1/items", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Host = test.host
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.StatusCode != test.status || string(body) != test.body {
+			t.Fatalf("response of %s is bad, got=(%d, %s)", test.host, resp.StatusCode, body)
+		}
+	}
+
+	if c1.Length() != 1 {
+		t.Fatalf("cache length is bad, got=%d", c1.Length())
+	}
+}
+
+func TestProxyHandler_ReverseOnly(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+
+	c1 := cache.NewLRUCache(1*size.MB, 0)
+	proxy := handler.NewProxy(
+		c1,
+		log.Println,
+		5*size.MB,
+		handler.NewStats(c1, log.Println),
+		http.DefaultTransport,
+	)
+	{
+		proxy.Routes = route.Table{{Prefix: "/v1/", Upstream: upstream.URL}}
+		if err := proxy.Routes.Init(); err != nil {
+			t.Fatal(err)
+		}
+		proxy.ReverseOnly = true
+	}
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+
+	resp, err := http.Get(proxyServer.URL + "/v1/items")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status code of route is bad (%v)", resp.StatusCode)
+	}
+
+	// the upstream is reachable through the route only
+	client := &http.Client{Transport: &http.Transport{Proxy: SetProxyURL(proxyServer.URL)}}
+	resp, err = client.Get(upstream.URL + "/internal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("status code of absolute url is bad (%v)", resp.StatusCode)
+	}
+
+	conn, err := net.Dial("tcp", proxyServer.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", upstream.Listener.Addr(), upstream.Listener.Addr())
+	resp, err = http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("status code of connect is bad (%v)", resp.StatusCode)
+	}
+}
+
+func TestProxyHTTPSHandler_TunnelPorts(t *testing.T) {
+	c1 := cache.NewLRUCache(1*size.MB, 0)
+	proxy := handler.NewProxy(
+		c1,
+		log.Println,
+		5*size.MB,
+		handler.NewStats(c1, log.Println),
+		http.DefaultTransport,
+	)
+	proxyServer := httptest.NewServer(proxy)
+
+	testHandler := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy:           SetProxyURL(proxyServer.URL),
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+
+	// only port 443 is allowed by default
+	_, err := client.Get(testHandler.URL)
+	if err == nil || !strings.Contains(err.Error(), "Forbidden") {
+		t.Fatalf("error is bad (%v)", err)
+	}
+
+	proxy.TunnelPorts = handler.Ports{strconv.Itoa(testHandler.Listener.Addr().(*net.TCPAddr).Port)}
+
+	resp, err := client.Get(testHandler.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status code is bad (%v)", resp.StatusCode)
+	}
+}
+
+func TestProxyHTTPSHandler_HTTP2(t *testing.T) {
+	c1 := cache.NewLRUCache(1*size.MB, 0)
+	stats := handler.NewStats(c1, log.Println)
+	proxy := handler.NewProxy(
+		c1,
+		log.Println,
+		5*size.MB,
+		stats,
+		http.DefaultTransport,
+	)
+	{
+		proxy.TunnelPorts = nil
+	}
+	proxyServer := httptest.NewUnstartedServer(proxy)
+	proxyServer.EnableHTTP2 = true
+	proxyServer.StartTLS()
+	defer proxyServer.Close()
+
+	testHandler := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"count": 10}`))
+	}))
+	defer testHandler.Close()
+
+	transport := proxyServer.Client().Transport.(*http.Transport)
+
+	// two tunnels are multiplexed over the connection to the proxy
+	for i := 0; i < 2; i++ {
+		pr, pw := io.Pipe()
+		req := &http.Request{
+			Method: http.MethodConnect,
+			URL:    &url.URL{Scheme: "https", Host: proxyServer.Listener.Addr().String()},
+			Host:   testHandler.Listener.Addr().String(),
+			Header: make(http.Header),
+			Body:   pr,
+		}
+
+		resp, err := transport.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.StatusCode != http.StatusOK || resp.ProtoMajor != 2 {
+			t.Fatalf("response is bad, got=(%d, %s)", resp.StatusCode, resp.Proto)
+		}
+
+		fmt.Fprintf(pw, "GET / HTTP/1.1\r\nHost: %s\r\n\r\n", req.Host)
+		tunneled, err := http.ReadResponse(bufio.NewReader(resp.Body), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(tunneled.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pw.Close()
+		resp.Body.Close()
+
+		if tunneled.StatusCode != http.StatusOK || string(body) != `{"count": 10}` {
+			t.Fatalf("tunneled response is bad, got=(%d, %s)", tunneled.StatusCode, body)
+		}
+	}
+
+	// the tunnels are counted once they're closed
+	deadline := time.Now().Add(time.Second)
+	for stats.Endpoint().Tunnels < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if endpoint := stats.Endpoint(); endpoint.Tunnels != 2 || endpoint.TunnelSeconds <= 0 {
+		t.Fatalf("tunnel stats are bad, got=%#v", endpoint)
+	}
+}
+
+func TestProxyHandler_H2C(t *testing.T) {
+	var requests int
+	testHandler := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"count": 10}`))
+	}))
+	defer testHandler.Close()
+
+	c1 := cache.NewLRUCache(1*size.MB, 0)
+	proxy := handler.NewProxy(
+		c1,
+		log.Println,
+		5*size.MB,
+		handler.NewStats(c1, log.Println),
+		http.DefaultTransport,
+	)
+	proxyServer := httptest.NewUnstartedServer(proxy)
+	proxyServer.Config.Protocols = new(http.Protocols)
+	proxyServer.Config.Protocols.SetHTTP1(true)
+	proxyServer.Config.Protocols.SetUnencryptedHTTP2(true)
+	proxyServer.Start()
+	defer proxyServer.Close()
+
+	transport := &http.Transport{Protocols: new(http.Protocols)}
+	transport.Protocols.SetUnencryptedHTTP2(true)
+	defer transport.CloseIdleConnections()
+
+	// a forward proxy request over h2c carries the target in :authority
+	for i := 0; i < 2; i++ {
+		req, err := http.NewRequest(http.MethodGet, proxyServer.URL+"/items", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Host = testHandler.Listener.Addr().String()
+
+		resp, err := transport.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK || resp.ProtoMajor != 2 || string(body) != `{"count": 10}` {
+			t.Fatalf("response is bad, got=(%d, %s, %s)", resp.StatusCode, resp.Proto, body)
+		}
+	}
+
+	if requests != 1 {
+		t.Fatalf("upstream requests are bad, got=%d", requests)
+	}
+	if c1.Length() != 1 {
+		t.Fatalf("cache length is bad, got=%d", c1.Length())
+	}
+}
+
+func TestProxyHandler_ExtendedConnect(t *testing.T) {
+	// the runtime reads the setting at start, so the test runs in a child process
+	if godebug := os.Getenv("GODEBUG"); !strings.Contains(godebug, "http2xconnect=1") {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestProxyHandler_ExtendedConnect$")
+		cmd.Env = append(os.Environ(), "GODEBUG="+strings.TrimPrefix(godebug+",http2xconnect=1", ","))
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("extended connect test failed (%v)\n%s", err, out)
+		}
+		return
+	}
+
+	testHandler := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "websocket" || r.Header.Get("Sec-WebSocket-Key") == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		conn, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Accept: x\r\n\r\n")
+		brw.Flush()
+		io.Copy(conn, brw)
+	}))
+	defer testHandler.Close()
+
+	c1 := cache.NewLRUCache(1*size.MB, 0)
+	proxy := handler.NewProxy(
+		c1,
+		log.Println,
+		5*size.MB,
+		handler.NewStats(c1, log.Println),
+		http.DefaultTransport,
+	)
+	proxyServer := httptest.NewUnstartedServer(proxy)
+	proxyServer.Config.Protocols = new(http.Protocols)
+	proxyServer.Config.Protocols.SetUnencryptedHTTP2(true)
+	proxyServer.Start()
+	defer proxyServer.Close()
+
+	// net/http refuses the :protocol pseudo header, so the frames are written by hand
+	conn, err := net.Dial("tcp", proxyServer.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	br := bufio.NewReader(conn)
+
+	conn.Write([]byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"))
+	writeFrame(conn, 0x4, 0, 0, nil) // settings
+
+	var block []byte
+	for _, field := range [][2]string{
+		{":method", "CONNECT"},
+		{":protocol", "websocket"},
+		{":scheme", "http"},
+		{":path", "/chat"},
+		{":authority", testHandler.Listener.Addr().String()},
+		{"sec-websocket-version", "13"},
+	} {
+		// literal header field without indexing, new name
+		block = append(block, 0x00, byte(len(field[0])))
+		block = append(block, field[0]...)
+		block = append(block, byte(len(field[1])))
+		block = append(block, field[1]...)
+	}
+
+	for sent := false; ; {
+		typ, flags, stream, payload := readFrame(t, br)
+		if typ == 0x4 && flags&0x1 == 0 {
+			connectProtocol := false
+			for i := 0; i+6 <= len(payload); i += 6 {
+				// SETTINGS_ENABLE_CONNECT_PROTOCOL
+				if payload[i] == 0 && payload[i+1] == 0x8 && payload[i+5] == 1 {
+					connectProtocol = true
+				}
+			}
+			if !connectProtocol && !sent {
+				t.Fatal("server doesn't offer extended connect")
+			}
+			writeFrame(conn, 0x4, 0x1, 0, nil) // settings ack
+			if !sent {
+				writeFrame(conn, 0x1, 0x4, 1, block) // headers, end headers
+				sent = true
+			}
+		}
+		if typ == 0x3 || typ == 0x7 {
+			t.Fatalf("stream is reset, got frame type %d (%x)", typ, payload)
+		}
+		if typ == 0x1 && stream == 1 {
+			// the static table index of ":status: 200"
+			if len(payload) == 0 || payload[0] != 0x88 {
+				t.Fatalf("response headers are bad, got=%x", payload)
+			}
+			break
+		}
+	}
+
+	writeFrame(conn, 0x0, 0, 1, []byte("ping\n")) // data
+	var echo []byte
+	for !bytes.HasSuffix(echo, []byte("\n")) {
+		typ, _, stream, payload := readFrame(t, br)
+		if typ == 0x0 && stream == 1 {
+			echo = append(echo, payload...)
+		}
+	}
+
+	if string(echo) != "ping\n" {
+		t.Fatalf("echo is bad, got=%q", echo)
+	}
+	if c1.Length() != 0 {
+		t.Fatalf("cache length is bad, got=%d", c1.Length())
+	}
+}
+
+// writeFrame writes an HTTP/2 frame (RFC 9113 section 4.1).
+func writeFrame(w io.Writer, typ, flags byte, stream uint32, payload []byte) {
+	header := []byte{byte(len(payload) >> 16), byte(len(payload) >> 8), byte(len(payload)), typ, flags,
+		byte(stream >> 24), byte(stream >> 16), byte(stream >> 8), byte(stream)}
+	w.Write(append(header, payload...))
+}
+
+func readFrame(t *testing.T, r io.Reader) (typ, flags byte, stream uint32, payload []byte) {
+	header := make([]byte, 9)
+	if _, err := io.ReadFull(r, header); err != nil {
+		t.Fatal(err)
+	}
+	payload = make([]byte, int(header[0])<<16|int(header[1])<<8|int(header[2]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		t.Fatal(err)
+	}
+	stream = uint32(header[5]&0x7f)<<24 | uint32(header[6])<<16 | uint32(header[7])<<8 | uint32(header[8])
+	return header[3], header[4], stream, payload
+}
+
+func TestProxyHandler_Upgrade(t *testing.T) {
+	defer c.Reset()
+
+	testHandler := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "echo" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		conn, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		brw.Flush()
+		io.Copy(conn, brw)
+	}))
+	defer testHandler.Close()
+
+	length := c.Length()
+
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	fmt.Fprintf(conn, "GET %s/ HTTP/1.1\r\nHost: %s\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n", testHandler.URL, testHandler.Listener.Addr())
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Upgrade") != "echo" {
+		t.Fatalf("response is bad, got=(%d, %s)", resp.StatusCode, resp.Header.Get("Upgrade"))
+	}
+
+	fmt.Fprint(conn, "ping\n")
+	line, err := br.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if line != "ping\n" {
+		t.Fatalf("echo is bad, got=%q", line)
+	}
+
+	if c.Length() != length {
+		t.Fatalf("cache length is bad, got=%d", c.Length())
+	}
+}
+
+func TestProxyHandler_HopHeaders(t *testing.T) {
+	defer c.Reset()
+
+	testHandler := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, name := range []string{"Proxy-Connection", "Keep-Alive", "X-Session"} {
+			if r.Header.Get(name) != "" {
+				t.Errorf("hop-by-hop header %s is forwarded", name)
+			}
+		}
+		if r.Header.Get("Via") != "1.1 httpcache" || r.Header.Get("X-Forwarded-For") != "10.0.0.1, 127.0.0.1" {
+			t.Errorf("forwarding headers are bad, got=(%s, %s)", r.Header.Get("Via"), r.Header.Get("X-Forwarded-For"))
+		}
+		w.Header().Set("Connection", "X-Hop")
+		w.Header().Set("X-Hop", "1")
+		w.Header().Set("Keep-Alive", "timeout=5")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer testHandler.Close()
+
+	for i := 0; i < 2; i++ {
+		req, err := http.NewRequest(http.MethodGet, testHandler.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Connection", "X-Session")
+		req.Header.Set("X-Session", "1")
+		req.Header.Set("Proxy-Connection", "keep-alive")
+		req.Header.Set("Keep-Alive", "timeout=5")
+		req.Header.Set("X-Forwarded-For", "10.0.0.1")
+
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.Header.Get("X-Hop") != "" || resp.Header.Get("Keep-Alive") != "" {
+			t.Fatalf("hop-by-hop headers of the response are forwarded, got=%v", resp.Header)
+		}
+		if resp.Header.Get("Via") != "1.1 httpcache" {
+			t.Fatalf("via header is bad, got=%s", resp.Header.Get("Via"))
+		}
+	}
+}